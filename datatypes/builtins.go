@@ -8,6 +8,9 @@ import "bufio"
 import "fmt"
 import "io/ioutil"
 import "strconv"
+import "errors"
+import "sort"
+import "log/slog"
 
 func MakeRandomRoundRobinDistributor(size int) Distributor {
 	count := 0
@@ -15,12 +18,12 @@ func MakeRandomRoundRobinDistributor(size int) Distributor {
 		rand.Seed(time.Now().UnixNano())
 		count = rand.Intn(size)
 	}
-	return func(data [2]string, channels []chan [2]string) {
-		if count >= len(channels) {
+	return func(data [2]string, n int) int {
+		if count >= n {
 			count = 0
 		}
-		channels[count] <- data
 		count++
+		return count - 1
 	}
 }
 
@@ -29,61 +32,85 @@ func MakeRoundRobinDistributor() Distributor {
 }
 
 func MakeHashDistributor() Distributor {
-	return func(data [2]string, channels []chan [2]string) {
+	return func(data [2]string, n int) int {
 		h := fnv.New32a()
 		h.Write([]byte(data[0]))
-		channels[int(h.Sum32())%len(channels)] <- data
+		return int(h.Sum32() % uint32(n))
 	}
 }
 
-func inputErr(err error) {
-	fmt.Printf("Input termination due to error: %v\n", err)
+//MakeRangeDistributor sends keys less than splits[0] to the first channel,
+//keys from splits[0] up to splits[1] to the second, and so on, with any keys
+//beyond the last split going to the last channel. The splits must be sorted
+//by less, which defaults to byte-wise order when nil. Feeding the last reduce
+//phase through a range distributor and setting Master.SortedOutput produces a
+//globally sorted output.
+func MakeRangeDistributor(less func(a, b string) bool, splits ...string) Distributor {
+	if less == nil {
+		less = func(a, b string) bool { return a < b }
+	}
+	return func(data [2]string, n int) int {
+		i := sort.Search(len(splits), func(i int) bool { return less(data[0], splits[i]) })
+		if i >= n {
+			i = n - 1
+		}
+		return i
+	}
+}
+
+func inputErr(logger *slog.Logger, err error) {
+	logger.Error("input terminated", "error", err)
 }
 
 //FileInput reads from a file, or all of the files in a directory.
 //Values are the entire line, keys are the filename and line number,
+//Errors are logged with the Master's logger, see FileInputErr to have them
+//reported to the Master.
 func FileInput(param string, emitter Emitter) {
+	if err := FileInputErr(param, emitter); err != nil {
+		inputErr(Task(emitter).Logger(), err)
+	}
+}
+
+//FileInputErr is the same as FileInput, but returns the first error
+//encountered instead of printing it.
+func FileInputErr(param string, emitter Emitter) error {
 
 	info, err := os.Stat(param)
 	if err != nil {
-		inputErr(err)
-		return
+		return err
 	}
 
 	if info.IsDir() {
 
 		dirs, err := ioutil.ReadDir(param)
 		if err != nil {
-			inputErr(err)
-			return
+			return err
 		}
 		for _, f := range dirs {
 			if f.Mode().IsRegular() {
-				file, err := os.Open(param + "/" + f.Name())
-				if err != nil {
-					inputErr(err)
-					return
+				if err := readFile(param+"/"+f.Name(), f.Name(), emitter); err != nil {
+					return err
 				}
-
-				scanner := bufio.NewScanner(file)
-				for i := 0; scanner.Scan(); i++ {
-					emitter.Emit(fmt.Sprintf("%s:%d", f.Name(), i), scanner.Text())
-				}
-				file.Close()
 			}
 		}
-	} else {
-		file, err := os.Open(param)
-		if err != nil {
-			inputErr(err)
-		}
+		return nil
+	}
+	return readFile(param, info.Name(), emitter)
+}
 
-		scanner := bufio.NewScanner(file)
-		for i := 0; scanner.Scan(); i++ {
-			emitter.Emit(fmt.Sprintf("%s:%d", info.Name(), i), scanner.Text())
-		}
-		file.Close()
+func readFile(path, name string, emitter Emitter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for i := 0; scanner.Scan(); i++ {
+		emitter.Emit(fmt.Sprintf("%s:%d", name, i), scanner.Text())
 	}
+	return scanner.Err()
 }
 
 //StdInput generates input from standard in,
@@ -94,54 +121,119 @@ func StdInput(param string, emitter Emitter) {
 	}
 }
 
-func outputErr(err error) {
-	fmt.Printf("Output failure due to error: %v\n", err)
+//Output functions have no emitter to find the Master's logger through, so
+//their errors are logged with the logger they were created with.
+func outputErr(logger *slog.Logger, err error) {
+	logger.Error("output failed", "error", err)
 }
 
 //This struct is used to pass values between functions.
 //The functions open a file, write the values to the file, then close it.
+//Errors are logged with Logger, or slog.Default() if it is nil, see
+//MakeFileOutputErr to have them reported to the Master.
 //See MakeFileOutput() for the same functionality using closures.
 type FileOutputStruct struct {
+	Logger *slog.Logger
+
 	f *os.File
 	w *bufio.Writer
 }
 
+func (g *FileOutputStruct) logger() *slog.Logger {
+	if g.Logger == nil {
+		return slog.Default()
+	}
+	return g.Logger
+}
+
 func (g *FileOutputStruct) InitFileOutput(param string) {
+	g.f, g.w = nil, nil
 	f, err := os.Create(param)
 	if err != nil {
-		outputErr(err)
+		outputErr(g.logger(), err)
 		return
 	}
 	g.f = f
 	g.w = bufio.NewWriter(f)
 }
 func (g *FileOutputStruct) GenFileOutput(param, key, value string) {
+	if g.w == nil {
+		return
+	}
 	fmt.Fprintln(g.w, value)
 }
 func (g *FileOutputStruct) EndFileOutput() {
+	if g.f == nil {
+		return
+	}
 	g.w.Flush()
 	g.f.Close()
 }
 
 //This function returns three functions for handling output.
 //The functions open a file, write the values to the file, then close it.
-//See FileOutputStruct for the same functionality using structs.
+//Errors are logged with slog.Default() as of when MakeFileOutput is called,
+//see MakeFileOutputErr to have them reported to the Master. Nothing is
+//written, and nothing more logged, if the file cannot be opened. See
+//FileOutputStruct for the same functionality using structs.
 func MakeFileOutput() (i func(param string), g func(param, key, value string), e func()) {
-	var f *os.File
-	var w *bufio.Writer
+	logger := slog.Default()
+	ie, ge, ee := MakeFileOutputErr()
+	open := false
 	i = func(param string) {
-		f, err := os.Create(param)
+		err := ie(param)
+		open = err == nil
 		if err != nil {
-			outputErr(err)
+			outputErr(logger, err)
 		}
-		w = bufio.NewWriter(f)
 	}
 	g = func(param, key, value string) {
-		fmt.Fprintln(w, value)
+		if !open {
+			return
+		}
+		if err := ge(param, key, value); err != nil {
+			outputErr(logger, err)
+		}
 	}
 	e = func() {
-		w.Flush()
-		f.Close()
+		if err := ee(); err != nil {
+			outputErr(logger, err)
+		}
+	}
+	return
+}
+
+//MakeFileOutputErr is the same as MakeFileOutput, but the functions return
+//their errors, for use with the error-returning fields of Output.
+func MakeFileOutputErr() (i func(param string) error, g func(param, key, value string) error, e func() error) {
+	var f *os.File
+	var w *bufio.Writer
+	i = func(param string) error {
+		var err error
+		w = nil
+		f, err = os.Create(param)
+		if err != nil {
+			return err
+		}
+		w = bufio.NewWriter(f)
+		return nil
+	}
+	g = func(param, key, value string) error {
+		if w == nil {
+			return errors.New("output file is not open")
+		}
+		_, err := fmt.Fprintln(w, value)
+		return err
+	}
+	e = func() error {
+		if f == nil {
+			return nil
+		}
+		err := w.Flush()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
 	}
 	return
 }
@@ -0,0 +1,143 @@
+package datatypes
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Counters maps the name of each counter to its value at the end of a run.
+//Counters maintained by the framework are named after their layer and phase,
+//e.g. "layer0.map.in" or "layer0.combine.in", or after their input or output,
+//e.g. "input.input.records" or "output.rejected.records".
+type Counters map[string]int64
+
+//counterSet holds the counters of a run. Each counter is updated atomically,
+//so it can be read while the run is going.
+type counterSet struct {
+	mu     sync.RWMutex
+	values map[string]*atomic.Int64
+}
+
+//counter returns the named counter, creating it if needed. Workers look up
+//their counters once, rather than for every record.
+func (c *counterSet) counter(name string) *atomic.Int64 {
+	c.mu.RLock()
+	counter, ok := c.values[name]
+	c.mu.RUnlock()
+	if ok {
+		return counter
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]*atomic.Int64)
+	}
+	if counter, ok = c.values[name]; !ok {
+		counter = new(atomic.Int64)
+		c.values[name] = counter
+	}
+	return counter
+}
+
+func (c *counterSet) add(name string, delta int64) {
+	c.counter(name).Add(delta)
+}
+
+func (c *counterSet) snapshot() Counters {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counters := make(Counters, len(c.values))
+	for name, value := range c.values {
+		counters[name] = value.Load()
+	}
+	return counters
+}
+
+func layerCounter(layer int, name string) string {
+	return fmt.Sprintf("layer%d.%s", layer, name)
+}
+
+func inputCounter(input string, name string) string {
+	return fmt.Sprintf("input.%s.%s", input, name)
+}
+
+func outputCounter(output string, name string) string {
+	return fmt.Sprintf("output.%s.%s", output, name)
+}
+
+//phaseCounters are the built-in counters of a worker's phase: the records
+//and bytes it receives and emits, and for reduce phases the distinct keys.
+type phaseCounters struct {
+	in       *atomic.Int64
+	inBytes  *atomic.Int64
+	out      *atomic.Int64
+	outBytes *atomic.Int64
+	keys     *atomic.Int64
+}
+
+func newPhaseCounters(s *state, layer int, phase string) phaseCounters {
+	name := func(counter string) string {
+		return layerCounter(layer, phase+"."+counter)
+	}
+	pc := phaseCounters{
+		in:       s.counters.counter(name("in")),
+		inBytes:  s.counters.counter(name("in.bytes")),
+		out:      s.counters.counter(name("out")),
+		outBytes: s.counters.counter(name("out.bytes")),
+	}
+	if phase == PhaseReduce {
+		pc.keys = s.counters.counter(name("keys"))
+	}
+	return pc
+}
+
+func (pc phaseCounters) received(data [2]string) {
+	pc.in.Add(1)
+	pc.inBytes.Add(int64(len(data[0]) + len(data[1])))
+}
+
+func (pc phaseCounters) emitted(key, value string) {
+	pc.out.Add(1)
+	pc.outBytes.Add(int64(len(key) + len(value)))
+}
+
+//timings records when each phase of a run started and finished. A phase
+//starts when its first worker receives its first record, and finishes when
+//its last worker finishes.
+type timings struct {
+	mu     sync.Mutex
+	phases map[string][2]time.Time
+}
+
+func (t *timings) record(name string, start time.Time) {
+	end := time.Now()
+	if start.IsZero() {
+		start = end
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.phases == nil {
+		t.phases = make(map[string][2]time.Time)
+	}
+	if times, ok := t.phases[name]; ok {
+		if times[0].Before(start) {
+			start = times[0]
+		}
+		if times[1].After(end) {
+			end = times[1]
+		}
+	}
+	t.phases[name] = [2]time.Time{start, end}
+}
+
+func (t *timings) durations() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	durations := make(map[string]time.Duration, len(t.phases))
+	for name, times := range t.phases {
+		durations[name] = times[1].Sub(times[0])
+	}
+	return durations
+}
@@ -0,0 +1,84 @@
+package datatypes
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestRunResult checks the built-in counters and the timings of a word count
+//with a combiner and a named output.
+func TestRunResult(t *testing.T) {
+	sum := func(key string, values []string, emitter Emitter) {
+		total := 0
+		for _, value := range values {
+			n, _ := strconv.Atoi(value)
+			total += n
+		}
+		emitter.Emit(key, strconv.Itoa(total))
+	}
+	m := Master{}
+	m.SetInput(pairInput([2]string{"1", "a b a"}, [2]string{"2", "b c"}, [2]string{"3", ""}))
+	m.SetLayer(1, Job{
+		Map: func(key string, value string, emitter Emitter) {
+			if value == "" {
+				EmitTo(emitter, "empty", key, value)
+			}
+			for _, word := range strings.Fields(value) {
+				emitter.Emit(word, "1")
+			}
+		},
+		Combine: sum,
+		Reduce:  sum,
+	})
+	var out, empty collector
+	m.SetOutput(out.output())
+	m.AddOutput("empty", empty.output())
+	//The second run checks that its timings do not start from the first.
+	for run := range 2 {
+		if run > 0 {
+			//Long enough for timings started in the first run to be longer
+			//than the whole second run.
+			time.Sleep(20 * time.Millisecond)
+		}
+		result, err := m.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Records != 3 {
+			t.Errorf("run %d: Records = %d, want 3", run, result.Records)
+		}
+		want := Counters{
+			"input.input.records":     3,
+			"layer0.map.in":           3,
+			"layer0.map.in.bytes":     11,
+			"layer0.map.out":          5,
+			"layer0.map.out.bytes":    10,
+			"layer0.combine.in":       5,
+			"layer0.combine.out":      3,
+			"layer0.reduce.in":        3,
+			"layer0.reduce.in.bytes":  6,
+			"layer0.reduce.keys":      3,
+			"layer0.reduce.out":       3,
+			"layer0.reduce.out.bytes": 6,
+			"output.empty.records":    1,
+		}
+		if !maps.Equal(result.Counters, want) {
+			t.Errorf("run %d: Counters = %v, want %v", run, result.Counters, want)
+		}
+
+		phases := slices.Sorted(maps.Keys(result.Timings))
+		if want := []string{PhaseInput, "layer0.map", "layer0.reduce", PhaseOutput}; !slices.Equal(phases, slices.Sorted(slices.Values(want))) {
+			t.Errorf("run %d: timed phases = %v, want %v", run, phases, want)
+		}
+		for phase, duration := range result.Timings {
+			if duration < 0 || duration > result.Duration {
+				t.Errorf("run %d: %s took %s, not within the run's %s", run, phase, duration, result.Duration)
+			}
+		}
+	}
+}
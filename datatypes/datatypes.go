@@ -3,9 +3,76 @@
 //Master struct and methods.
 package datatypes
 
-func end(channels []chan [2]string) {
-	for _, channel := range channels {
-		channel <- [2]string{"\x00", ""}
+import "fmt"
+
+type messageKind int
+
+const (
+	//dataMessage carries a key-value pair.
+	dataMessage messageKind = iota
+	//endMessage signals that an upstream goroutine has finished sending.
+	endMessage
+)
+
+//message is the envelope sent on the channels between goroutines. Marking
+//the end of a stream in the kind rather than in the data allows keys and
+//values to hold any bytes. source is the name of the input or stage that
+//sent the data. pair is the typed key and value that data encodes, if a
+//TypedJob emitted it, so that they need not be decoded again, see typedPair.
+type message struct {
+	kind   messageKind
+	source string
+	data   [2]string
+	pair   any
+}
+
+//A route is a set of downstream channels, along with the distributor that
+//selects which of them receives each key-value pair.
+type route struct {
+	channels   []chan message
+	distribute distributeFn
+}
+
+//distributeFn is the form of a distributor used by routes, which is also
+//given the typed pair of the data, if there is one.
+type distributeFn func(data [2]string, pair any, n int) int
+
+//distributeData returns the distributeFn of a Distributor, or nil if it is
+//nil.
+func distributeData(distribute Distributor) distributeFn {
+	if distribute == nil {
+		return nil
+	}
+	return func(data [2]string, pair any, n int) int {
+		return distribute(data, n)
+	}
+}
+
+//send sends the data along every route, using each route's distributor to
+//select one of its channels.
+func send(routes []route, source string, data [2]string, pair any) {
+	for _, r := range routes {
+		r.channels[r.distribute(data, pair, len(r.channels))] <- message{kind: dataMessage, source: source, data: data, pair: pair}
+	}
+}
+
+//end signals completion on every channel of every route.
+func end(routes []route) {
+	for _, r := range routes {
+		for _, channel := range r.channels {
+			channel <- message{kind: endMessage}
+		}
+	}
+}
+
+//drain discards everything left on a channel until every upstream goroutine
+//has signaled completion, so that nothing upstream blocks forever once a run
+//has been cancelled.
+func drain(numUpstream int, inChannel chan message) {
+	for numUpstream > 0 {
+		if msg := <-inChannel; msg.kind == endMessage {
+			numUpstream--
+		}
 	}
 }
 
@@ -15,6 +82,45 @@ type Emitter interface {
 	Emit(key string, value string)
 }
 
-//Distributors are functions that handle which channel receives a given
-//key-value pair.
-type Distributor func(data [2]string, channels []chan [2]string)
+type sourcer interface {
+	source() string
+}
+
+type outputEmitter interface {
+	emitTo(name, key, value string) error
+}
+
+//Source returns the name of the input or stage that sent the record being
+//mapped, given the emitter passed to a Map function (or to the Map function
+//of a TypedJob). Otherwise it returns "". This allows a single Map function
+//to tell apart the records of several inputs, e.g. for a reduce-side join.
+func Source(emitter interface{}) string {
+	if s, ok := emitter.(sourcer); ok {
+		return s.source()
+	}
+	return ""
+}
+
+//EmitTo sends a key-value pair to the output added with Master.AddOutput
+//under the given name, given the emitter passed to a Map, Reduce or Combine
+//function at any layer. An error is returned if there is no such output.
+func EmitTo(emitter interface{}, name, key, value string) error {
+	if o, ok := emitter.(outputEmitter); ok {
+		return o.emitTo(name, key, value)
+	}
+	return fmt.Errorf("emitter cannot send to output %q", name)
+}
+
+//emitTo sends a key-value pair to one of the outputs.
+func emitTo(outputs map[string]chan message, source, name, key, value string) error {
+	outChannel, ok := outputs[name]
+	if !ok {
+		return fmt.Errorf("no output named %q", name)
+	}
+	outChannel <- message{kind: dataMessage, source: source, data: [2]string{key, value}}
+	return nil
+}
+
+//Distributors are functions that return the index of the channel, out of n,
+//that receives a given key-value pair.
+type Distributor func(data [2]string, n int) int
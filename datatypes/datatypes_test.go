@@ -0,0 +1,159 @@
+package datatypes
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+//TestNULKeys is a regression test for the end of a stream being signaled
+//in-band with a "\x00" key, which dropped records with that key and ended
+//their worker's input early.
+func TestNULKeys(t *testing.T) {
+	pairs := [][2]string{{"\x00", ""}, {"a", "\x00"}, {"\x00", "x"}, {"", ""}, {"\x00\x00", "\x00"}}
+	tests := []struct {
+		name string
+		job  Job
+	}{
+		{"map and reduce", Job{Map: identityMap, Reduce: func(key string, values []string, emitter Emitter) {
+			for _, value := range values {
+				emitter.Emit(key, value)
+			}
+		}}},
+		{"map-only", Job{Map: identityMap}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out collector
+			m := Master{}
+			m.SetInput(pairInput(pairs...))
+			m.SetLayer(3, test.job)
+			m.SetLayer(2, test.job)
+			m.SetOutput(out.output())
+			result, err := m.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := (&collector{pairs: pairs}).sorted()
+			if got := out.sorted(); !slices.Equal(got, want) {
+				t.Errorf("output = %q, want %q", got, want)
+			}
+			if result.Records != len(pairs) {
+				t.Errorf("Records = %d, want %d", result.Records, len(pairs))
+			}
+		})
+	}
+}
+
+//TestEmitTo sends to named outputs from every kind of function, and checks
+//that each named output is initialized and ended once per run.
+func TestEmitTo(t *testing.T) {
+	join := func(key string, values []string, emitter Emitter) {
+		value := strings.Join(values, ",")
+		if err := EmitTo(emitter, "combined", key, value); err != nil {
+			t.Error(err)
+		}
+		emitter.Emit(key, value)
+	}
+	m := Master{}
+	m.SetInput(pairInput([2]string{"a", "1"}, [2]string{"b", "2"}, [2]string{"a", "3"}))
+	m.SetLayer(1, Job{
+		Map: func(key string, value string, emitter Emitter) {
+			if err := EmitTo(emitter, "mapped", key, value); err != nil {
+				t.Error(err)
+			}
+			if err := EmitTo(emitter, "none", key, value); err == nil {
+				t.Error("EmitTo() sent to an unknown output")
+			}
+			emitter.Emit(key, value)
+		},
+		Combine: join,
+		Reduce: func(key string, values []string, emitter Emitter) {
+			if err := EmitTo(emitter, "reduced", key, values[0]); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	var out collector
+	m.SetOutput(out.output())
+	//events records the calls made to each named output, which run
+	//concurrently.
+	events := make(map[string]*[]string)
+	for _, name := range []string{"mapped", "combined", "reduced"} {
+		e := new([]string)
+		events[name] = e
+		m.AddOutput(name, Output{
+			Param:      name,
+			InitOutput: func(param string) { *e = append(*e, "init "+param) },
+			GenOutput:  func(param, key, value string) { *e = append(*e, key+"="+value) },
+			EndOutput:  func() { *e = append(*e, "end") },
+		})
+	}
+	want := map[string][]string{
+		"mapped":   {"init mapped", "a=1", "a=3", "b=2", "end"},
+		"combined": {"init combined", "a=1,3", "b=2", "end"},
+		"reduced":  {"init reduced", "a=1,3", "b=2", "end"},
+	}
+	for run := range 2 {
+		for _, e := range events {
+			*e = nil
+		}
+		result, err := m.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, e := range events {
+			//The records may arrive in any order between the first and last
+			//events.
+			if len(*e) > 2 {
+				slices.Sort((*e)[1 : len(*e)-1])
+			}
+			if !slices.Equal(*e, want[name]) {
+				t.Errorf("run %d: output %q got %q, want %q", run, name, *e, want[name])
+			}
+		}
+		if len(out.pairs) != 0 || result.Records != 0 {
+			t.Errorf("run %d: output = %q, want nothing", run, out.pairs)
+		}
+	}
+
+	if err := EmitTo(nil, "mapped", "k", "v"); err == nil {
+		t.Error("EmitTo(nil) returned no error")
+	}
+}
+
+func TestDistributors(t *testing.T) {
+	tests := []struct {
+		name       string
+		distribute Distributor
+		keys       []string
+		want       []int
+	}{
+		{"round robin", MakeRoundRobinDistributor(), []string{"a", "a", "b", "c", "d"}, []int{0, 1, 2, 0, 1}},
+		{"range", MakeRangeDistributor(nil, "b", "d"), []string{"a", "b", "c", "d", "z"}, []int{0, 1, 1, 2, 2}},
+		{"range beyond n", MakeRangeDistributor(nil, "b", "d", "f"), []string{"a", "e", "g"}, []int{0, 2, 2}},
+		{"range with less", MakeRangeDistributor(func(a, b string) bool { return a > b }, "m"), []string{"z", "a"}, []int{0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []int
+			for _, key := range test.keys {
+				got = append(got, test.distribute([2]string{key, ""}, 3))
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("channels = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	hash := MakeHashDistributor()
+	for _, key := range []string{"", "\x00", "a", "key"} {
+		i := hash([2]string{key, "1"}, 4)
+		if i < 0 || i >= 4 {
+			t.Errorf("hash of %q = %d, out of range", key, i)
+		}
+		if j := hash([2]string{key, "2"}, 4); j != i {
+			t.Errorf("hash of %q = %d and %d, depending on the value", key, i, j)
+		}
+	}
+}
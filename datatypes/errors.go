@@ -0,0 +1,55 @@
+package datatypes
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+//The phases of a run, used to report where an error occurred.
+const (
+	PhaseInput   = "input"
+	PhaseMap     = "map"
+	PhaseCombine = "combine"
+	PhaseReduce  = "reduce"
+	PhaseOutput  = "output"
+)
+
+//JobError records where in the pipeline a run failed. Layer and Worker are
+//-1 for errors from the input or output.
+type JobError struct {
+	Layer  int
+	Phase  string
+	Worker int
+	Key    string
+	Err    error
+}
+
+func (e *JobError) Error() string {
+	if e.Layer < 0 {
+		return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("layer %d %s worker %d, key %q: %v", e.Layer, e.Phase, e.Worker, e.Key, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+//PanicError is reported in place of a panic in a map or reduce function.
+//The record being processed is skipped, see Master.MaxBadRecords.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+//recoverPanic must be deferred directly. It turns a panic into a *PanicError
+//stored in err.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = &PanicError{Value: r, Stack: debug.Stack()}
+	}
+}
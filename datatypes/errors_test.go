@@ -0,0 +1,169 @@
+package datatypes
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+//TestErrorBudget checks when errors abort a run, and where the JobErrors
+//returned by the run say they happened.
+func TestErrorBudget(t *testing.T) {
+	failed := errors.New("failed")
+	//last sends every pair to the last channel, so that the worker which
+	//fails is known.
+	last := func(data [2]string, n int) int { return n - 1 }
+	mapErr := func(key string, value string, emitter Emitter) error {
+		if value == "bad" {
+			return failed
+		}
+		emitter.Emit(key, value)
+		return nil
+	}
+	reduceErr := func(key string, values []string, emitter Emitter) error {
+		if slices.Contains(values, "bad") {
+			return failed
+		}
+		for _, value := range values {
+			emitter.Emit(key, value)
+		}
+		return nil
+	}
+	identity := LayerSpec{Job: Job{Map: identityMap}}
+	good := [][2]string{{"a", "1"}, {"b", "2"}}
+	oneBad := [][2]string{{"a", "1"}, {"x", "bad"}, {"b", "2"}}
+	twoBad := append(slices.Clone(oneBad), [2]string{"y", "bad"})
+	tests := []struct {
+		name       string
+		maxErrors  int
+		input      [][2]string
+		specs      []LayerSpec
+		failInput  bool
+		failOutput bool
+		errs       []JobError
+		//out is the output of a run which was not aborted, nil otherwise.
+		out [][2]string
+	}{
+		{
+			name:  "map, aborted on the first error",
+			input: oneBad,
+			specs: []LayerSpec{{Job: Job{MapErr: mapErr}, MapWorkers: 2}},
+			errs:  []JobError{{Layer: 0, Phase: PhaseMap, Worker: 1, Key: "x"}},
+		},
+		{
+			name:      "map, within a budget of 1",
+			maxErrors: 1,
+			input:     oneBad,
+			specs:     []LayerSpec{{Job: Job{MapErr: mapErr}, MapWorkers: 2}},
+			errs:      []JobError{{Layer: 0, Phase: PhaseMap, Worker: 1, Key: "x"}},
+			out:       good,
+		},
+		{
+			name:      "map, over a budget of 1",
+			maxErrors: 1,
+			input:     twoBad,
+			specs:     []LayerSpec{{Job: Job{MapErr: mapErr}, MapWorkers: 2}},
+			errs:      []JobError{{Layer: 0, Phase: PhaseMap, Worker: 1, Key: "x"}, {Layer: 0, Phase: PhaseMap, Worker: 1, Key: "y"}},
+		},
+		{
+			name:      "map, within a budget of 2",
+			maxErrors: 2,
+			input:     twoBad,
+			specs:     []LayerSpec{{Job: Job{MapErr: mapErr}, MapWorkers: 2}},
+			errs:      []JobError{{Layer: 0, Phase: PhaseMap, Worker: 1, Key: "x"}, {Layer: 0, Phase: PhaseMap, Worker: 1, Key: "y"}},
+			out:       good,
+		},
+		{
+			name:      "reduce in the second layer",
+			maxErrors: 1,
+			input:     oneBad,
+			specs:     []LayerSpec{identity, {Job: Job{Map: identityMap, ReduceErr: reduceErr, MapDistribute: last}, ReduceWorkers: 3}},
+			errs:      []JobError{{Layer: 1, Phase: PhaseReduce, Worker: 2, Key: "x"}},
+			out:       good,
+		},
+		{
+			name:      "input",
+			input:     good,
+			failInput: true,
+			specs:     []LayerSpec{identity},
+			errs:      []JobError{{Layer: -1, Phase: PhaseInput, Worker: -1}},
+		},
+		{
+			name:      "input, within budget",
+			maxErrors: 1,
+			input:     good,
+			failInput: true,
+			specs:     []LayerSpec{identity},
+			errs:      []JobError{{Layer: -1, Phase: PhaseInput, Worker: -1}},
+			out:       good,
+		},
+		{
+			name:       "output",
+			input:      oneBad,
+			specs:      []LayerSpec{identity},
+			failOutput: true,
+			errs:       []JobError{{Layer: -1, Phase: PhaseOutput, Worker: -1, Key: "x"}},
+		},
+		{
+			name:       "output, within budget",
+			maxErrors:  1,
+			input:      oneBad,
+			specs:      []LayerSpec{identity},
+			failOutput: true,
+			errs:       []JobError{{Layer: -1, Phase: PhaseOutput, Worker: -1, Key: "x"}},
+			out:        good,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := pairInput(test.input...)
+			if test.failInput {
+				genInput := input.GenInput
+				input = Input{GenInputErr: func(param string, emitter Emitter) error {
+					genInput(param, emitter)
+					return failed
+				}}
+			}
+			input.Distribute = last
+			var out collector
+			output := out.output()
+			if test.failOutput {
+				output = Output{GenOutputErr: func(param, key, value string) error {
+					if value == "bad" {
+						return failed
+					}
+					out.pairs = append(out.pairs, [2]string{key, value})
+					return nil
+				}}
+			}
+
+			m := Master{MaxErrors: test.maxErrors}
+			m.SetInput(input)
+			for _, spec := range test.specs {
+				m.AddLayer(spec)
+			}
+			m.SetOutput(output)
+			_, err := m.Run()
+			if err == nil {
+				t.Fatal("Run() returned no error")
+			}
+			var errs []JobError
+			for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var je *JobError
+				if !errors.As(err, &je) || !errors.Is(err, failed) {
+					t.Fatalf("error %v is not a JobError wrapping the function's error", err)
+				}
+				errs = append(errs, JobError{Layer: je.Layer, Phase: je.Phase, Worker: je.Worker, Key: je.Key})
+			}
+			if !slices.Equal(errs, test.errs) {
+				t.Errorf("errors = %+v, want %+v", errs, test.errs)
+			}
+			if test.out == nil {
+				return
+			}
+			if got := out.sorted(); !slices.Equal(got, test.out) {
+				t.Errorf("output = %q, want %q", got, test.out)
+			}
+		})
+	}
+}
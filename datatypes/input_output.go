@@ -1,34 +1,74 @@
 package datatypes
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 //Input is used to generate data to be processed.
 type Input struct {
-	endpoints []chan [2]string
+	name        string
+	routes      []route
+	done        <-chan struct{}
+	taskContext *TaskContext
+	records     *atomic.Int64
 
 	Param      string
 	//GenInput is a single, user-defined function that emits all of the data
 	//to be processed.
 	GenInput   func(param string, emitter Emitter)
-	Distribute Distributor
+	//GenInputErr may be supplied instead of GenInput. A returned error is
+	//reported to the Master.
+	GenInputErr func(param string, emitter Emitter) error
+	Distribute  Distributor
 }
 
+//Emit drops the data once the run has been cancelled, so that GenInput can
+//finish without anything downstream having to process it.
 func (i *Input) Emit(key string, value string) {
-	i.Distribute([2]string{key, value}, i.endpoints)
+	select {
+	case <-i.done:
+		return
+	default:
+	}
+	i.records.Add(1)
+	send(i.routes, i.name, [2]string{key, value}, nil)
 }
 
-func (i *Input) run() {
-	i.GenInput(i.Param, i)
-	end(i.endpoints)
+func (i *Input) task() *TaskContext {
+	return i.taskContext
+}
+
+func (i *Input) run(s *state) {
+	start := time.Now()
+	i.done = s.ctx.Done()
+	i.taskContext = newTaskContext(s, i.name, -1, PhaseInput, -1)
+	i.records = s.counters.counter(inputCounter(i.name, "records"))
+	i.taskContext.logger.Debug("input started")
+	if err := i.GenInputErr(i.Param, i); err != nil {
+		s.fail(&JobError{Layer: -1, Phase: PhaseInput, Worker: -1, Err: err})
+	}
+	s.timings.record(PhaseInput, start)
+	i.taskContext.logger.Debug("input finished")
+	end(i.routes)
 }
 
-func (i *Input) init(endpoints []chan [2]string) {
-	i.endpoints = endpoints
+func (i *Input) init(routes []route) {
+	i.routes = routes
 }
 
 //Output is used to handle the data that has been processed.
 type Output struct {
+	name        string
 	numUpstream int
-	inChannel   chan [2]string
+	inChannel   chan message
+	//ordered holds a channel for each upstream worker instead, when the
+	//workers must be read one at a time. See Master.SortedOutput.
+	ordered     []chan message
 	endChannel  chan int
+	err         error
+	//started is when the first record was received.
+	started     time.Time
 
 	Param      string
 	//InitOutput is run before the output starts accepting data.
@@ -39,29 +79,88 @@ type Output struct {
 	//EndOutput is run when the output has finished accepting data.
 	//The master will ensure this function is never nil.
 	EndOutput  func()
+
+	//InitOutputErr, GenOutputErr and EndOutputErr may be supplied instead of
+	//their counterparts above. A failure to initialize the output aborts the
+	//run, other errors are reported to the Master.
+	InitOutputErr func(param string) error
+	GenOutputErr  func(param, key, value string) error
+	EndOutputErr  func() error
 }
 
-func (o *Output) run() {
-	o.InitOutput(o.Param)
+//run stops accepting data as soon as the context is done. EndOutput is still
+//called, and the rest of the data is drained so the workers can finish.
+func (o *Output) run(s *state) {
+	logger := s.logger.With("phase", PhaseOutput, "output", o.name)
+	logger.Debug("output started")
+	defer logger.Debug("output finished")
+	sources, numUpstream := o.sources()
+	if err := o.InitOutputErr(o.Param); err != nil {
+		s.abort(&JobError{Layer: -1, Phase: PhaseOutput, Worker: -1, Err: err})
+		o.endChannel <- 0
+		for _, inChannel := range sources {
+			drain(numUpstream, inChannel)
+		}
+		return
+	}
 	count := 0
-	for {
-		data := <-o.inChannel
-		if data[0] == "\x00" {
-			o.numUpstream--
-			if o.numUpstream == 0 {
-				break
+	for i, inChannel := range sources {
+		remaining := numUpstream
+		for remaining > 0 {
+			select {
+			case msg := <-inChannel:
+				if msg.kind == endMessage {
+					remaining--
+					continue
+				}
+				if o.started.IsZero() {
+					o.started = time.Now()
+				}
+				if err := o.GenOutputErr(o.Param, msg.data[0], msg.data[1]); err != nil {
+					s.fail(&JobError{Layer: -1, Phase: PhaseOutput, Worker: -1, Key: msg.data[0], Err: err})
+					continue
+				}
+				count++
+			case <-s.ctx.Done():
+				o.err = s.ctx.Err()
+				o.end(s)
+				o.endChannel <- count
+				drain(remaining, inChannel)
+				for _, rest := range sources[i+1:] {
+					drain(numUpstream, rest)
+				}
+				return
 			}
-			continue
 		}
-		o.GenOutput(o.Param, data[0], data[1])
-		count++
 	}
+	o.end(s)
 	o.endChannel <- count
-	o.EndOutput()
 }
 
-func (o *Output) init(numUpstream int, inChannel chan [2]string) {
+//sources returns the channels to read, one after the other, and the number
+//of upstream goroutines sending to each of them.
+func (o *Output) sources() ([]chan message, int) {
+	if o.ordered != nil {
+		return o.ordered, 1
+	}
+	return []chan message{o.inChannel}, o.numUpstream
+}
+
+func (o *Output) end(s *state) {
+	if err := o.EndOutputErr(); err != nil {
+		s.fail(&JobError{Layer: -1, Phase: PhaseOutput, Worker: -1, Err: err})
+	}
+}
+
+func (o *Output) init(numUpstream int, inChannel chan message) {
 	o.numUpstream = numUpstream
 	o.inChannel = inChannel
 	o.endChannel = make(chan int)
+	o.started = time.Time{}
+}
+
+func (o *Output) initOrdered(ordered []chan message) {
+	o.ordered = ordered
+	o.endChannel = make(chan int)
+	o.started = time.Time{}
 }
@@ -1,14 +1,99 @@
 package datatypes
 
+import "iter"
+
 type MapFn func(key string, value string, emitter Emitter)
 type RedFn func(key string, values []string, emitter Emitter)
 
-//The user must supply a Map function and a Reduce function.
-//The default distributor for the map function is a hash-based distributor,
-//and the default for the reduce function is a round robin.
+//MapErrFn and RedErrFn are variants of MapFn and RedFn that can fail.
+//A returned error is reported to the Master, which aborts the run once its
+//error budget is exceeded.
+type MapErrFn func(key string, value string, emitter Emitter) error
+type RedErrFn func(key string, values []string, emitter Emitter) error
+
+//RedIterFn is a variant of RedErrFn that receives the values one at a time,
+//so that a key with any number of values can be reduced in constant memory
+//(see Job.ReduceMemory). The values can only be iterated once, and only
+//until the function returns.
+type RedIterFn func(key string, values iter.Seq[string], emitter Emitter) error
+
+//The user must supply a Map function, a Reduce function or both, either of
+//which may be given as its error-returning variant instead. The Reduce
+//function may also be given as ReduceIter to receive its values one at a time.
+//The default distributor for output sent to a Reduce function is a hash-based
+//distributor, and the default for anything else is a round robin.
 type Job struct {
 	Map           MapFn
 	Reduce        RedFn
+	MapErr        MapErrFn
+	ReduceErr     RedErrFn
+	ReduceIter    RedIterFn
 	MapDistribute Distributor
 	RedDistribute Distributor
+
+	//Combine is optionally run by each map worker on its own output before
+	//it is distributed, to shrink the data sent to the reduce workers. The
+	//output is buffered per key, and combined whenever CombineBuffer records
+	//(1000 by default) have been buffered and at the end of the input.
+	//Combine must accept its own output as input, since a key may be
+	//combined more than once.
+	Combine       RedFn
+	CombineBuffer int
+
+	//ReduceMemory is the number of bytes of keys and values each reduce
+	//worker buffers in memory. Beyond it, the buffers are sorted and spilled
+	//to temporary files under the Master's BaseDir, and merged again when
+	//the reduce phase starts. By default there is no limit.
+	ReduceMemory int
+
+	//Reduce is called in sorted key order. KeyLess optionally replaces the
+	//default ordering of the keys, which is byte-wise.
+	KeyLess func(a, b string) bool
+	//ValueLess optionally sorts the values passed to Reduce for each key.
+	//Otherwise they are passed in the order in which they were received.
+	ValueLess func(a, b string) bool
+
+	//typed is set for the Job of a TypedJob.
+	typed *typedLayer
+}
+
+const defaultCombineBuffer = 1000
+
+func (j Job) hasMap() bool {
+	return j.Map != nil || j.MapErr != nil
+}
+
+func (j Job) hasReduce() bool {
+	return j.Reduce != nil || j.ReduceErr != nil || j.ReduceIter != nil
+}
+
+func (j Job) mapFn() MapErrFn {
+	if j.MapErr != nil {
+		return j.MapErr
+	}
+	return func(key string, value string, emitter Emitter) error {
+		j.Map(key, value, emitter)
+		return nil
+	}
+}
+
+func (j Job) redFn() RedErrFn {
+	if j.ReduceErr != nil || j.ReduceIter != nil {
+		return j.ReduceErr
+	}
+	return func(key string, values []string, emitter Emitter) error {
+		j.Reduce(key, values, emitter)
+		return nil
+	}
+}
+
+//LayerSpec configures a layer with its own number of map and reduce workers,
+//at least one of each. MapBuffer and ReduceBuffer are the sizes of the
+//workers' input channels, 100 by default.
+type LayerSpec struct {
+	Job           Job
+	MapWorkers    int
+	ReduceWorkers int
+	MapBuffer     int
+	ReduceBuffer  int
 }
@@ -1,108 +1,477 @@
 package datatypes
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
 //The framework is used by initializing and running a master.
 type Master struct {
+	//Name and Params are available to Map and Reduce functions through
+	//their TaskContext, see Task.
+	Name    string
+	Params  map[string]string
 	BaseDir string
+	//MaxErrors is the number of errors tolerated before the run is aborted.
+	//By default the run is aborted on the first error.
+	MaxErrors int
+	//MaxBadRecords is the number of records (or keys, for reduce functions)
+	//whose function panicked, or that a TypedJob could not decode, that are
+	//skipped before the run is aborted. By default the run is aborted on the
+	//first bad record.
+	MaxBadRecords int
+	//SortedOutput writes the output of the last layer's reduce workers one
+	//worker at a time, in order, instead of as it is generated. Since each
+	//reduce worker handles its keys in sorted order, the output is globally
+	//sorted if the last Job's MapDistribute is a range distributor. Only a
+	//single stage, ending in a reduce phase, may be connected to the output.
+	SortedOutput bool
+
+	inputs []*Input
+	//sideInputs are loaded before the run starts, see AddSideInput.
+	sideInputs []*Input
+	stages []*stage
+	edges  []edge
+	output Output
+	//outputs are the named outputs, written to with EmitTo.
+	outputs []*Output
 
-	input   Input
-	workers [][]worker
-	output  Output
+	deadLetter *Output
+	badRecords int
+	counters   Counters
+	logger     *slog.Logger
+	//state is the state of the current or last run, for Progress.
+	state atomic.Pointer[state]
+}
+
+//RunResult describes a completed run.
+type RunResult struct {
+	//Records is the number of records written to the output.
+	Records int
+	//BadRecords is the number of records skipped, see MaxBadRecords.
+	BadRecords int
+	//Counters holds the built-in counters of every layer and output, and the
+	//counters added to by Map and Reduce functions.
+	Counters Counters
+	//Timings holds how long each phase ran for, from its first record until
+	//its last worker finished. Phases are named like their counters, e.g.
+	//"layer0.map", along with PhaseInput and PhaseOutput.
+	Timings map[string]time.Duration
+	//Duration is how long the whole run took.
+	Duration time.Duration
 }
 
 //The user must set the input, supplying at least the GenInput function.
+//The input is known as InputName when connecting stages.
 func (m *Master) SetInput(input Input) {
-	if input.Distribute == nil {
-		input.Distribute = MakeRoundRobinDistributor()
+	for i, in := range m.inputs {
+		if in.name == InputName {
+			m.inputs = append(m.inputs[:i], m.inputs[i+1:]...)
+			break
+		}
 	}
-	m.input = input
+	m.AddInput(InputName, input)
+}
+
+//AddInput adds a named input, alongside any others. All of the inputs run
+//concurrently, and unless stages are connected explicitly they all feed the
+//first layer. Map functions can tell which input a record came from with
+//Source.
+func (m *Master) AddInput(name string, input Input) {
+	input = defaultInput(input)
+	input.name = name
+	m.inputs = append(m.inputs, &input)
+}
+
+//AddSideInput adds a named side input, such as a lookup table, that is fully
+//loaded before the workers start. Map and Reduce functions read it through
+//Task(emitter).SideInput(name). Loading it is part of Start, so it is loaded
+//again on every run.
+func (m *Master) AddSideInput(name string, input Input) {
+	input = defaultInput(input)
+	input.name = name
+	m.sideInputs = append(m.sideInputs, &input)
 }
 
 //The user must set each layer, specifying the number of goroutines to use and 
-//supplying at least the Map and Reduce functions.
+//supplying at least the Map or the Reduce function. A layer without a Reduce
+//function is map-only: the output of its Map function is sent straight to the
+//next layer. A layer without a Map function is reduce-only: its Reduce
+//function groups the output of the previous layer by key.
 func (m *Master) SetLayer(num int, job Job) {
-	var mapLayer []worker
-	var redLayer []worker
-	for i := 0; i < num; i++ {
-		mapDistribute := job.MapDistribute
-		if mapDistribute == nil {
-			mapDistribute = MakeHashDistributor()
+	m.AddLayer(LayerSpec{Job: job, MapWorkers: num, ReduceWorkers: num})
+}
+
+//AddLayer is like SetLayer, but sizes the map and reduce phases of the layer
+//independently.
+func (m *Master) AddLayer(spec LayerSpec) {
+	m.AddStage(fmt.Sprintf("layer%d", len(m.stages)), spec)
+}
+
+//The user must set the output, supplying at least the GenOutput function.
+//The output is known as OutputName when connecting stages.
+func (m *Master) SetOutput(output Output) {
+	m.output = defaultOutput(output)
+	m.output.name = OutputName
+}
+
+//AddOutput adds a named output alongside the main one. It only receives the
+//records sent to it with EmitTo, which any Map, Reduce or Combine function
+//can call, e.g. for rejected records or secondary indexes. Its count is
+//recorded in the counter "output.<name>.records".
+func (m *Master) AddOutput(name string, output Output) {
+	output = defaultOutput(output)
+	output.name = name
+	m.outputs = append(m.outputs, &output)
+}
+
+//SetDeadLetter optionally sets an output that receives every record skipped
+//because its map or reduce function panicked. For reduce functions, every
+//value of the key is sent, except for ReduceIter, whose values are streamed
+//and cannot be sent again. Its skipped keys are only counted, in the counter
+//"layer<N>.reduce.streamed.skipped".
+func (m *Master) SetDeadLetter(output Output) {
+	output = defaultOutput(output)
+	output.name = "deadLetter"
+	m.deadLetter = &output
+}
+
+//Progress is a snapshot of a run, see Master.Progress.
+type Progress struct {
+	//Running is false before the run starts and once it has finished.
+	Running bool
+	Elapsed time.Duration
+	//Counters holds the current values of the counters, see RunResult.
+	Counters Counters
+	//Backlog holds the number of records waiting in the channels of each
+	//phase, named like the counters, e.g. "layer0.reduce", and PhaseOutput.
+	Backlog map[string]int
+	//FinishedWorkers of Workers have finished.
+	FinishedWorkers int
+	Workers         int
+}
+
+//Progress returns a snapshot of the current run, or of the last run once it
+//has finished. It is safe to call from other goroutines while the run is
+//going.
+func (m *Master) Progress() Progress {
+	progress := Progress{Workers: m.numWorkers()}
+	s := m.state.Load()
+	if s == nil {
+		return progress
+	}
+	progress.Running = !s.done.Load()
+	progress.Elapsed = time.Since(s.start)
+	progress.Counters = s.counters.snapshot()
+	progress.FinishedWorkers = int(s.finished.Load())
+	progress.Backlog = make(map[string]int)
+	for layer, st := range m.stages {
+		for _, p := range st.phases {
+			name := PhaseMap
+			if p.reduce {
+				name = PhaseReduce
+			}
+			backlog := 0
+			for _, ch := range p.channels {
+				backlog += len(ch)
+			}
+			progress.Backlog[layerCounter(layer, name)] = backlog
 		}
-		mapLayer = append(mapLayer, &mapWorker{
-			distribute: mapDistribute,
-			Map:        job.Map,
-		})
-		redDistribute := job.RedDistribute
-		if redDistribute == nil {
-			redDistribute = MakeRoundRobinDistributor()
+	}
+	backlog := len(m.output.inChannel)
+	for _, ch := range m.output.ordered {
+		backlog += len(ch)
+	}
+	progress.Backlog[PhaseOutput] = backlog
+	return progress
+}
+
+//SetLogger sets the logger used by the run, which is slog.Default() unless
+//set. The handler of the logger decides the format, level and destination
+//of the logs. Every line is tagged with the Master's Name, and the lines of
+//the input, output and workers with where in the pipeline they come from.
+//Errors are logged as they are reported, and the start and end of the run
+//and of each worker at the debug level, so nothing but errors and skipped
+//records is logged at the default level.
+func (m *Master) SetLogger(logger *slog.Logger) {
+	m.logger = logger
+}
+
+//BadRecords returns the number of records skipped during the last run.
+func (m *Master) BadRecords() int {
+	return m.badRecords
+}
+
+//Counters returns the counters gathered during the last run.
+func (m *Master) Counters() Counters {
+	return m.counters
+}
+
+func defaultInput(input Input) Input {
+	if input.GenInputErr == nil {
+		genInput := input.GenInput
+		input.GenInputErr = func(param string, emitter Emitter) error {
+			genInput(param, emitter)
+			return nil
 		}
-		redLayer = append(redLayer, &redWorker{
-			distribute: redDistribute,
-			Reduce:     job.Reduce,
-		})
 	}
-	m.workers = append(m.workers, mapLayer)
-	m.workers = append(m.workers, redLayer)
+	return input
 }
 
-//The user must set the output, supplying at least the GenOutput function.
-func (m *Master) SetOutput(output Output) {
+func defaultOutput(output Output) Output {
 	if output.InitOutput == nil {
 		output.InitOutput = func(param string) {}
 	}
 	if output.EndOutput == nil {
 		output.EndOutput = func() {}
 	}
-	m.output = output
+	if output.InitOutputErr == nil {
+		initOutput := output.InitOutput
+		output.InitOutputErr = func(param string) error {
+			initOutput(param)
+			return nil
+		}
+	}
+	if output.GenOutputErr == nil {
+		genOutput := output.GenOutput
+		output.GenOutputErr = func(param, key, value string) error {
+			genOutput(param, key, value)
+			return nil
+		}
+	}
+	if output.EndOutputErr == nil {
+		endOutput := output.EndOutput
+		output.EndOutputErr = func() error {
+			endOutput()
+			return nil
+		}
+	}
+	return output
 }
 
 //Build builds the channels that the goroutines will use to communicate.
-func (m *Master) Build() {
-	outChannel := make(chan [2]string, 100)
-
-	var channels [][]chan [2]string
-	for i := 0; i < len(m.workers); i++ {
-		var newChannels []chan [2]string
-		for j := 0; j < len(m.workers[i]); j++ {
-			newChannels = append(newChannels, make(chan [2]string, 100))
+//Unless a distributor was supplied, everything sent to a reduce phase is
+//distributed by hash, and everything else by round robin. An error is
+//returned if the stages do not form a valid pipeline, see Connect.
+func (m *Master) Build() error {
+	edges, order, err := m.graph()
+	if err != nil {
+		return err
+	}
+	outputNames := make(map[string]bool)
+	for _, o := range m.outputs {
+		if o.name == OutputName || outputNames[o.name] {
+			return fmt.Errorf("output name %q is already in use", o.name)
+		}
+		outputNames[o.name] = true
+	}
+	sideInputNames := make(map[string]bool)
+	for _, in := range m.sideInputs {
+		if sideInputNames[in.name] {
+			return fmt.Errorf("side input name %q is already in use", in.name)
+		}
+		sideInputNames[in.name] = true
+	}
+	byName := make(map[string]*stage)
+	for _, st := range order {
+		byName[st.name] = st
+		for _, p := range st.phases {
+			p.channels = nil
+			for range p.workers {
+				p.channels = append(p.channels, make(chan message, p.bufferSize()))
+			}
+		}
+	}
+
+	numUpstream := make(map[string]int)
+	var ordered []chan message
+	for _, e := range edges {
+		if st := byName[e.from]; st != nil {
+			numUpstream[e.to] += len(st.last().workers)
+		} else {
+			numUpstream[e.to]++
+		}
+		if e.to == OutputName && m.SortedOutput {
+			if ordered != nil {
+				return errors.New("sorted output requires a single stage connected to the output")
+			}
+			if !byName[e.from].last().reduce {
+				return fmt.Errorf("sorted output requires stage %q to end in a reduce phase", e.from)
+			}
+			for range byName[e.from].last().workers {
+				ordered = append(ordered, make(chan message, defaultBuffer))
+			}
 		}
-		channels = append(channels, newChannels)
 	}
-	for j := 0; j < len(m.workers[0]); j++ {
-		m.workers[0][j].init(1, channels[0][j], channels[1])
+
+	outChannel := make(chan message, defaultBuffer)
+	//routes returns the routes for the jth goroutine of an input or of the
+	//last phase of a stage, one for each of its connections.
+	routes := func(name string, distribute distributeFn, j int) []route {
+		var routes []route
+		for _, e := range edges {
+			if e.from != name {
+				continue
+			}
+			if e.to != OutputName {
+				first := byName[e.to].first()
+				routes = append(routes, route{channels: first.channels, distribute: distributor(distribute, first.reduce)})
+			} else if ordered != nil {
+				routes = append(routes, route{channels: ordered[j : j+1], distribute: distributor(distribute, false)})
+			} else {
+				routes = append(routes, route{channels: []chan message{outChannel}, distribute: distributor(distribute, false)})
+			}
+		}
+		return routes
 	}
-	for i := 1; i < len(m.workers)-1; i++ {
-		for j := 0; j < len(m.workers[i]); j++ {
-			m.workers[i][j].init(len(m.workers[i-1]), channels[i][j], channels[i+1])
+
+	for _, st := range order {
+		for k, p := range st.phases {
+			upstream := numUpstream[st.name]
+			if k > 0 {
+				upstream = len(st.phases[k-1].workers)
+			}
+			for j, w := range p.workers {
+				if k < len(st.phases)-1 {
+					next := st.phases[k+1]
+					w.init(upstream, p.channels[j], []route{{channels: next.channels, distribute: distributor(p.distribute, next.reduce)}})
+				} else {
+					w.init(upstream, p.channels[j], routes(st.name, p.distribute, j))
+				}
+			}
 		}
 	}
-	last := len(m.workers) - 1
-	for j := 0; j < len(m.workers[last]); j++ {
-		m.workers[last][j].init(len(m.workers[last-1]), channels[last][j], []chan [2]string{outChannel})
+
+	for _, in := range m.inputs {
+		in.init(routes(in.name, distributeData(in.Distribute), 0))
+	}
+
+	if ordered != nil {
+		m.output.initOrdered(ordered)
+	} else {
+		m.output.init(numUpstream[OutputName], outChannel)
 	}
 
-	m.input.init(channels[0])
+	if m.deadLetter != nil {
+		m.deadLetter.init(m.numWorkers(), make(chan message, defaultBuffer))
+	}
+	for _, o := range m.outputs {
+		o.init(m.numWorkers(), make(chan message, defaultBuffer))
+	}
+	return nil
+}
 
-	m.output.init(len(m.workers[last]), outChannel)
+func (m *Master) numWorkers() int {
+	numWorkers := 0
+	for _, st := range m.stages {
+		for _, p := range st.phases {
+			numWorkers += len(p.workers)
+		}
+	}
+	return numWorkers
+}
 
-	m.output.numUpstream = len(m.workers[last])
-	m.output.inChannel = outChannel
-	m.output.endChannel = make(chan int)
+//distributor returns the supplied distributor, or a new default one.
+func distributor(distribute distributeFn, toReduce bool) distributeFn {
+	if distribute != nil {
+		return distribute
+	} else if toReduce {
+		return distributeData(MakeHashDistributor())
+	}
+	return distributeData(MakeRoundRobinDistributor())
 }
 
 //Start starts all of the goroutines and waits for the output.
-func (m *Master) Start() int {
-	go m.input.run()
-	for _, workers := range m.workers {
-		for _, worker := range workers {
-			go worker.run()
+//It returns the result of the run and any errors reported during the run, as
+//*JobError values joined together.
+func (m *Master) Start() (RunResult, error) {
+	return m.StartContext(context.Background())
+}
+
+//StartContext is like Start, but stops the input, the workers and the output
+//when the context is cancelled or times out. The output is still ended
+//properly, and the result so far is returned along with the context's
+//error, once every goroutine of the run has returned. A function that
+//ignores the context of its task delays that until it returns. If a side
+//input cannot be loaded, or the context is done while they are loaded,
+//nothing is started and the error is returned.
+func (m *Master) StartContext(ctx context.Context) (RunResult, error) {
+	start := time.Now()
+	s := newState(ctx, m)
+	defer s.cancel()
+	defer s.done.Store(true)
+	m.state.Store(s)
+	sideInputs, err := loadSideInputs(s, m.sideInputs)
+	if err != nil {
+		return RunResult{}, err
+	}
+	s.sideInputs = sideInputs
+	s.logger.Debug("run started")
+
+	for _, in := range m.inputs {
+		s.running.Go(func() { in.run(s) })
+	}
+	for _, st := range m.stages {
+		for _, p := range st.phases {
+			for _, w := range p.workers {
+				s.running.Go(func() { w.run(s) })
+			}
 		}
 	}
-	go m.output.run()
-	return <-m.output.endChannel
+	s.running.Go(func() { m.output.run(s) })
+	if m.deadLetter != nil {
+		s.running.Go(func() { m.deadLetter.run(s) })
+	}
+	for _, o := range m.outputs {
+		s.running.Go(func() { o.run(s) })
+	}
+	count := <-m.output.endChannel
+	s.timings.record(PhaseOutput, m.output.started)
+	if m.deadLetter != nil {
+		<-m.deadLetter.endChannel
+	}
+	for _, o := range m.outputs {
+		s.counters.add(outputCounter(o.name, "records"), int64(<-o.endChannel))
+	}
+	//A cancelled output ends before the workers feeding it have stopped.
+	s.running.Wait()
+	m.badRecords = s.skipped()
+	m.counters = s.counters.snapshot()
+	result := RunResult{
+		Records:    count,
+		BadRecords: m.badRecords,
+		Counters:   m.counters,
+		Timings:    s.timings.durations(),
+		Duration:   time.Since(start),
+	}
+	s.logger.Debug("run finished", "records", result.Records, "badRecords", result.BadRecords, "duration", result.Duration)
+	if err := s.err(); err != nil {
+		return result, err
+	}
+	if m.output.err == nil {
+		//The output can end by itself once the input and workers have stopped
+		//early, without seeing that the context is done.
+		return result, ctx.Err()
+	}
+	return result, m.output.err
 }
 
 //Run calls Build() and then Start()
-func (m *Master) Run() int {
-	m.Build()
+func (m *Master) Run() (RunResult, error) {
+	if err := m.Build(); err != nil {
+		return RunResult{}, err
+	}
 	return m.Start()
 }
+
+//RunContext calls Build() and then StartContext()
+func (m *Master) RunContext(ctx context.Context) (RunResult, error) {
+	if err := m.Build(); err != nil {
+		return RunResult{}, err
+	}
+	return m.StartContext(ctx)
+}
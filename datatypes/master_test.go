@@ -0,0 +1,284 @@
+package datatypes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//pairInput returns an Input emitting the pairs in order.
+func pairInput(pairs ...[2]string) Input {
+	return Input{GenInput: func(param string, emitter Emitter) {
+		for _, p := range pairs {
+			emitter.Emit(p[0], p[1])
+		}
+	}}
+}
+
+//collector is an Output recording everything it receives.
+type collector struct {
+	pairs [][2]string
+}
+
+func (c *collector) output() Output {
+	return Output{GenOutput: func(param, key, value string) {
+		c.pairs = append(c.pairs, [2]string{key, value})
+	}}
+}
+
+//sorted returns the pairs in sorted order, for outputs written by several
+//workers.
+func (c *collector) sorted() [][2]string {
+	pairs := slices.Clone(c.pairs)
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	return pairs
+}
+
+func identityMap(key string, value string, emitter Emitter) {
+	emitter.Emit(key, value)
+}
+
+//TestInputs runs several inputs at once, one of which has its own
+//distributor, and checks that the Map function can tell them apart.
+func TestInputs(t *testing.T) {
+	m := Master{}
+	m.SetInput(pairInput([2]string{"1", "a"}, [2]string{"2", "b"}))
+	left := pairInput([2]string{"1", "c"}, [2]string{"2", "d"}, [2]string{"3", "e"})
+	left.Distribute = func(data [2]string, n int) int { return n - 1 }
+	m.AddInput("left", left)
+	m.AddInput("right", pairInput([2]string{"3", "f"}))
+	m.AddLayer(LayerSpec{Job: Job{Map: func(key string, value string, emitter Emitter) {
+		//The worker is only known for the input with its own distributor.
+		if Source(emitter) == "left" {
+			value = fmt.Sprintf("%s worker %d", value, Task(emitter).Worker())
+		}
+		emitter.Emit(key, Source(emitter)+" "+value)
+	}}, MapWorkers: 3})
+	var out collector
+	m.SetOutput(out.output())
+	result, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"1", "input a"}, {"1", "left c worker 2"},
+		{"2", "input b"}, {"2", "left d worker 2"},
+		{"3", "left e worker 2"}, {"3", "right f"},
+	}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	for name, want := range map[string]int64{InputName: 2, "left": 3, "right": 1} {
+		if got := result.Counters["input."+name+".records"]; got != want {
+			t.Errorf("input %q read %d records, want %d", name, got, want)
+		}
+	}
+}
+
+//TestLogger checks that a run without errors logs nothing at the default
+//level.
+func TestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	var out collector
+	m := &Master{Name: "test"}
+	m.SetLogger(slog.New(slog.NewJSONHandler(&logs, nil)))
+	m.SetInput(pairInput([2]string{"a", "1"}))
+	m.SetLayer(1, Job{Map: identityMap})
+	m.SetOutput(out.output())
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("logs = %s, want none", logs.String())
+	}
+}
+
+//TestFileOutputErrors checks that the built-in file outputs log a file that
+//cannot be opened once, both within a run and called directly.
+func TestFileOutputErrors(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+	outputs := map[string]func() Output{
+		"MakeFileOutput": func() Output {
+			i, g, e := MakeFileOutput()
+			return Output{InitOutput: i, GenOutput: g, EndOutput: e}
+		},
+		"FileOutputStruct": func() Output {
+			f := &FileOutputStruct{}
+			return Output{InitOutput: f.InitFileOutput, GenOutput: f.GenFileOutput, EndOutput: f.EndFileOutput}
+		},
+		"FileOutputStruct with a logger": func() Output {
+			f := &FileOutputStruct{Logger: logger.With("own", true)}
+			return Output{InitOutput: f.InitFileOutput, GenOutput: f.GenFileOutput, EndOutput: f.EndFileOutput}
+		},
+	}
+	for name, newOutput := range outputs {
+		t.Run(name, func(t *testing.T) {
+			param := t.TempDir() + "/missing/out"
+			//checkLogs checks that the logs hold a single line for the
+			//file that could not be opened.
+			checkLogs := func(how string) {
+				t.Helper()
+				var line map[string]any
+				if err := json.NewDecoder(&logs).Decode(&line); err != nil {
+					t.Fatalf("%s: logs = %s: %v", how, logs.String(), err)
+				}
+				if line["msg"] != "output failed" || line["error"] == nil {
+					t.Errorf("%s: logged %v, want the output error", how, line)
+				}
+				if name == "FileOutputStruct with a logger" && line["own"] != true {
+					t.Errorf("%s: logged %v, not with the output's own logger", how, line)
+				}
+				if logs.Len() > 0 {
+					t.Errorf("%s: logged more: %s", how, logs.String())
+				}
+				logs.Reset()
+			}
+
+			o := newOutput()
+			o.InitOutput(param)
+			for range 3 {
+				o.GenOutput(param, "a", "1")
+			}
+			o.EndOutput()
+			checkLogs("called directly")
+
+			o = newOutput()
+			o.Param = param
+			m := &Master{}
+			m.SetLogger(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+			m.SetInput(pairInput([2]string{"a", "1"}, [2]string{"b", "2"}))
+			m.SetLayer(1, Job{Map: identityMap})
+			m.SetOutput(o)
+			if _, err := m.Run(); err != nil {
+				t.Fatalf("Run() = %v, want the output error logged only", err)
+			}
+			checkLogs("run")
+		})
+	}
+}
+
+//TestRunContext checks that a cancelled run returns the context's error, even
+//when the output ended by itself once the input had stopped early, which
+//returned a partial result with no error.
+func TestRunContext(t *testing.T) {
+	//The output only ends by itself before it sees that the context is done
+	//when the workers run in parallel with it.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	//countInput emits records until the run is cancelled, or until n have
+	//been emitted.
+	countInput := func(n int) Input {
+		return Input{GenInput: func(param string, emitter Emitter) {
+			for i := 0; i < n && Task(emitter).Context().Err() == nil; i++ {
+				emitter.Emit(strconv.Itoa(i), "")
+			}
+		}}
+	}
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		//job is given the context's cancel function.
+		job func(cancel context.CancelFunc) Job
+		n   int
+		err error
+		//runs is how many times the case is run, since its outcome depends
+		//on scheduling.
+		runs int
+	}{
+		{"not cancelled", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, func(context.CancelFunc) Job { return Job{Map: identityMap} }, 100, nil, 100},
+		{"cancelled before the run", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, func(context.CancelFunc) Job { return Job{Map: identityMap} }, 100, context.Canceled, 2000},
+		{"cancelled during the run", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, func(cancel context.CancelFunc) Job {
+			return Job{Map: func(key string, value string, emitter Emitter) {
+				if key == "10" {
+					cancel()
+				}
+				emitter.Emit(key, value)
+			}}
+		}, -1, context.Canceled, 100},
+		{"timed out", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), time.Millisecond)
+		}, func(context.CancelFunc) Job { return Job{Map: identityMap} }, -1, context.DeadlineExceeded, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for range test.runs {
+				ctx, cancel := test.ctx()
+				n := test.n
+				if n < 0 {
+					n = math.MaxInt
+				}
+				ended := false
+				m := Master{}
+				m.SetInput(countInput(n))
+				m.SetLayer(2, test.job(cancel))
+				m.SetOutput(Output{GenOutput: func(param, key, value string) {}, EndOutput: func() { ended = true }})
+				result, err := m.RunContext(ctx)
+				cancel()
+				if !errors.Is(err, test.err) {
+					t.Fatalf("RunContext() = %v, want %v", err, test.err)
+				}
+				if !ended {
+					t.Fatal("the output was not ended")
+				}
+				if test.err == nil && result.Records != n {
+					t.Fatalf("Records = %d, want %d", result.Records, n)
+				}
+			}
+		})
+	}
+}
+
+//TestRunContextWaits checks that a cancelled run only returns once every
+//goroutine of it has stopped, even a Map function that ignores the context.
+func TestRunContextWaits(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var running atomic.Int32
+	m := Master{}
+	m.SetInput(pairInput([2]string{"a", ""}, [2]string{"b", ""}, [2]string{"c", ""}))
+	m.SetLayer(2, Job{Map: func(key string, value string, emitter Emitter) {
+		running.Add(1)
+		defer running.Add(-1)
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		emitter.Emit(key, value)
+	}})
+	m.SetOutput(Output{GenOutput: func(param, key, value string) {}})
+	if _, err := m.RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunContext() = %v, want %v", err, context.Canceled)
+	}
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d Map calls still running", n)
+	}
+	if progress := m.Progress(); progress.FinishedWorkers != progress.Workers {
+		t.Errorf("%d of %d workers finished", progress.FinishedWorkers, progress.Workers)
+	}
+}
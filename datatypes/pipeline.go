@@ -0,0 +1,217 @@
+package datatypes
+
+import (
+	"errors"
+	"fmt"
+)
+
+//InputName and OutputName refer to the input set with SetInput and to the
+//output when connecting stages.
+const (
+	InputName  = "input"
+	OutputName = "output"
+)
+
+//A stage is a named layer of the pipeline, made of a map phase, a reduce
+//phase or both.
+type stage struct {
+	name   string
+	phases []*phase
+}
+
+//first and last return nil for a stage without phases, which graph rejects.
+func (st *stage) first() *phase {
+	if len(st.phases) == 0 {
+		return nil
+	}
+	return st.phases[0]
+}
+
+func (st *stage) last() *phase {
+	if len(st.phases) == 0 {
+		return nil
+	}
+	return st.phases[len(st.phases)-1]
+}
+
+type edge struct {
+	from, to string
+}
+
+//AddStage adds a named layer to the pipeline. Unlike SetLayer and AddLayer,
+//which chain each layer to the one before it, stages must be connected to the
+//input, the output and each other with Connect. A stage fed by several others
+//receives all of their output, and a stage feeding several others sends each
+//of them all of its output.
+func (m *Master) AddStage(name string, spec LayerSpec) {
+	job := spec.Job
+	layer := len(m.stages)
+	st := &stage{name: name}
+	mapDistribute, redDistribute := distributeData(job.MapDistribute), distributeData(job.RedDistribute)
+	var typed *typedLayer
+	if job.typed != nil {
+		if job.typed.mapDistribute != nil {
+			mapDistribute = job.typed.mapDistribute
+		}
+		if job.typed.redDistribute != nil {
+			redDistribute = job.typed.redDistribute
+		}
+		if job.typed.reduce != nil {
+			typed = job.typed
+		}
+	}
+	if job.hasMap() {
+		combineSize := job.CombineBuffer
+		if combineSize <= 0 {
+			combineSize = defaultCombineBuffer
+		}
+		mapPhase := &phase{buffer: spec.MapBuffer, distribute: mapDistribute}
+		for i := 0; i < max(spec.MapWorkers, 1); i++ {
+			mapPhase.workers = append(mapPhase.workers, &mapWorker{
+				stage: name,
+				layer: layer,
+				index: i,
+				Map:   job.mapFn(),
+
+				combine:     job.Combine,
+				combineSize: combineSize,
+			})
+		}
+		st.phases = append(st.phases, mapPhase)
+	}
+	if job.hasReduce() {
+		redPhase := &phase{reduce: true, buffer: spec.ReduceBuffer, distribute: redDistribute}
+		for i := 0; i < max(spec.ReduceWorkers, 1); i++ {
+			redPhase.workers = append(redPhase.workers, &redWorker{
+				stage:      name,
+				layer:      layer,
+				index:      i,
+				Reduce:     job.redFn(),
+				ReduceIter: job.ReduceIter,
+				typed:      typed,
+
+				keyLess:   job.KeyLess,
+				valueLess: job.ValueLess,
+				memory:    job.ReduceMemory,
+			})
+		}
+		st.phases = append(st.phases, redPhase)
+	}
+	m.stages = append(m.stages, st)
+}
+
+//Connect sends everything emitted by the stage named from to the stage named
+//to, or from the input named from to the stage named to. OutputName may be
+//used to connect a stage to the output. Once anything is connected, layers
+//are no longer chained automatically.
+func (m *Master) Connect(from, to string) {
+	m.edges = append(m.edges, edge{from, to})
+}
+
+//graph returns the edges of the pipeline, connecting every input to the
+//first layer and chaining the layers in order if nothing was connected, and
+//checks that they form a valid DAG from the inputs to the output: every stage
+//must have a Map or a Reduce function, every input and stage must be
+//connected on both sides, and there must be no cycles. The stages are
+//returned in topological order.
+func (m *Master) graph() ([]edge, []*stage, error) {
+	if len(m.inputs) == 0 {
+		return nil, nil, errors.New("the pipeline has no input")
+	}
+	if len(m.stages) == 0 {
+		return nil, nil, errors.New("the pipeline has no layers")
+	}
+	edges := m.edges
+	if len(edges) == 0 {
+		for _, in := range m.inputs {
+			edges = append(edges, edge{in.name, m.stages[0].name})
+		}
+		for i := 1; i < len(m.stages); i++ {
+			edges = append(edges, edge{m.stages[i-1].name, m.stages[i].name})
+		}
+		edges = append(edges, edge{m.stages[len(m.stages)-1].name, OutputName})
+	}
+
+	inputs := make(map[string]bool)
+	for _, in := range m.inputs {
+		if in.name == OutputName {
+			return nil, nil, fmt.Errorf("input name %q is reserved", in.name)
+		}
+		if inputs[in.name] {
+			return nil, nil, fmt.Errorf("duplicate input %q", in.name)
+		}
+		inputs[in.name] = true
+	}
+	stages := make(map[string]*stage)
+	for _, st := range m.stages {
+		if st.name == OutputName {
+			return nil, nil, fmt.Errorf("stage name %q is reserved", st.name)
+		}
+		if stages[st.name] != nil || inputs[st.name] {
+			return nil, nil, fmt.Errorf("duplicate stage %q", st.name)
+		}
+		if len(st.phases) == 0 {
+			return nil, nil, fmt.Errorf("stage %q has neither a Map nor a Reduce function", st.name)
+		}
+		stages[st.name] = st
+	}
+
+	seen := make(map[edge]bool)
+	incoming := make(map[string]int)
+	outgoing := make(map[string][]string)
+	for _, e := range edges {
+		if !inputs[e.from] && stages[e.from] == nil {
+			return nil, nil, fmt.Errorf("unknown stage %q connected to %q", e.from, e.to)
+		}
+		if e.to != OutputName && stages[e.to] == nil {
+			return nil, nil, fmt.Errorf("%q connected to unknown stage %q", e.from, e.to)
+		}
+		if inputs[e.from] && e.to == OutputName {
+			return nil, nil, fmt.Errorf("input %q cannot be connected to the output", e.from)
+		}
+		if seen[e] {
+			return nil, nil, fmt.Errorf("%q connected to %q twice", e.from, e.to)
+		}
+		seen[e] = true
+		incoming[e.to]++
+		outgoing[e.from] = append(outgoing[e.from], e.to)
+	}
+	for _, in := range m.inputs {
+		if len(outgoing[in.name]) == 0 {
+			return nil, nil, fmt.Errorf("input %q is not connected", in.name)
+		}
+	}
+	if incoming[OutputName] == 0 {
+		return nil, nil, errors.New("the output is not connected")
+	}
+	for _, st := range m.stages {
+		if incoming[st.name] == 0 {
+			return nil, nil, fmt.Errorf("stage %q has no upstream connection", st.name)
+		}
+		if len(outgoing[st.name]) == 0 {
+			return nil, nil, fmt.Errorf("stage %q has no downstream connection", st.name)
+		}
+	}
+
+	var order []*stage
+	var queue []string
+	for _, in := range m.inputs {
+		queue = append(queue, in.name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if st := stages[name]; st != nil {
+			order = append(order, st)
+		}
+		for _, to := range outgoing[name] {
+			if incoming[to]--; incoming[to] == 0 && to != OutputName {
+				queue = append(queue, to)
+			}
+		}
+	}
+	if len(order) < len(m.stages) {
+		return nil, nil, errors.New("the pipeline contains a cycle")
+	}
+	return edges, order, nil
+}
@@ -0,0 +1,227 @@
+package datatypes
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	mapOnly    = LayerSpec{Job: Job{Map: identityMap}}
+	reduceOnly = LayerSpec{Job: Job{Reduce: func(key string, values []string, emitter Emitter) {
+		for _, value := range values {
+			emitter.Emit(key, value)
+		}
+	}}}
+)
+
+//TestGraphErrors checks that invalid pipelines are rejected by Build with an
+//error, rather than panicking or hanging.
+func TestGraphErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(m *Master)
+		err   string
+	}{
+		{"no input", func(m *Master) {
+			m.inputs = nil
+			m.SetLayer(1, Job{Map: identityMap})
+		}, "no input"},
+		{"no layers", func(m *Master) {}, "no layers"},
+		{"empty job", func(m *Master) {
+			m.SetLayer(2, Job{})
+		}, `stage "layer0" has neither a Map nor a Reduce function`},
+		{"empty stage", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.AddStage("b", LayerSpec{})
+			m.Connect(InputName, "a")
+			m.Connect("a", "b")
+			m.Connect("b", OutputName)
+		}, `stage "b" has neither`},
+		{"duplicate stage", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.AddStage("a", mapOnly)
+		}, `duplicate stage "a"`},
+		{"stage named like an input", func(m *Master) {
+			m.AddStage(InputName, mapOnly)
+		}, `duplicate stage "input"`},
+		{"reserved stage name", func(m *Master) {
+			m.AddStage(OutputName, mapOnly)
+		}, "is reserved"},
+		{"unknown source", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.Connect("b", "a")
+		}, `unknown stage "b"`},
+		{"unknown destination", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.Connect("a", "b")
+		}, `unknown stage "b"`},
+		{"input to output", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.Connect(InputName, OutputName)
+		}, "cannot be connected to the output"},
+		{"connected twice", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.Connect(InputName, "a")
+			m.Connect(InputName, "a")
+		}, "twice"},
+		{"input not connected", func(m *Master) {
+			m.AddInput("other", pairInput())
+			m.AddStage("a", mapOnly)
+			m.Connect(InputName, "a")
+			m.Connect("a", OutputName)
+		}, `input "other" is not connected`},
+		{"output not connected", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.Connect(InputName, "a")
+		}, "output is not connected"},
+		{"no upstream", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.AddStage("b", mapOnly)
+			m.Connect(InputName, "a")
+			m.Connect("a", OutputName)
+			m.Connect("b", OutputName)
+		}, `stage "b" has no upstream`},
+		{"no downstream", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.AddStage("b", mapOnly)
+			m.Connect(InputName, "a")
+			m.Connect("a", "b")
+			m.Connect("a", OutputName)
+		}, `stage "b" has no downstream`},
+		{"cycle", func(m *Master) {
+			m.AddStage("a", mapOnly)
+			m.AddStage("b", mapOnly)
+			m.AddStage("c", mapOnly)
+			m.Connect(InputName, "a")
+			m.Connect("a", "b")
+			m.Connect("b", "c")
+			m.Connect("c", "b")
+			m.Connect("c", OutputName)
+		}, "cycle"},
+		{"duplicate output", func(m *Master) {
+			m.SetLayer(1, Job{Map: identityMap})
+			m.AddOutput("side", Output{GenOutput: func(param, key, value string) {}})
+			m.AddOutput("side", Output{GenOutput: func(param, key, value string) {}})
+		}, `output name "side" is already in use`},
+		{"sorted output of two stages", func(m *Master) {
+			m.SortedOutput = true
+			m.AddStage("a", reduceOnly)
+			m.AddStage("b", reduceOnly)
+			m.Connect(InputName, "a")
+			m.Connect(InputName, "b")
+			m.Connect("a", OutputName)
+			m.Connect("b", OutputName)
+		}, "single stage"},
+		{"sorted output of a map-only layer", func(m *Master) {
+			m.SortedOutput = true
+			m.SetLayer(1, reduceOnly.Job)
+			m.SetLayer(2, mapOnly.Job)
+		}, `stage "layer1" to end in a reduce phase`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &Master{}
+			m.SetInput(pairInput())
+			m.SetOutput(Output{GenOutput: func(param, key, value string) {}})
+			test.build(m)
+			err := m.Build()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Build() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+//TestDAG runs a pipeline where one stage feeds two others, which are joined
+//again by a reduce-only stage.
+func TestDAG(t *testing.T) {
+	suffix := func(s string) LayerSpec {
+		return LayerSpec{Job: Job{Map: func(key string, value string, emitter Emitter) {
+			emitter.Emit(key, value+s)
+		}}, MapWorkers: 2}
+	}
+	var out collector
+	m := Master{}
+	m.SetInput(pairInput([2]string{"k1", "v1"}, [2]string{"k2", "v2"}))
+	m.AddStage("split", mapOnly)
+	m.AddStage("a", suffix("a"))
+	m.AddStage("b", suffix("b"))
+	m.AddStage("join", LayerSpec{Job: Job{Reduce: func(key string, values []string, emitter Emitter) {
+		slices.Sort(values)
+		emitter.Emit(key, strings.Join(values, ","))
+	}}, ReduceWorkers: 2})
+	m.Connect(InputName, "split")
+	m.Connect("split", "a")
+	m.Connect("split", "b")
+	m.Connect("a", "join")
+	m.Connect("b", "join")
+	m.Connect("join", OutputName)
+	m.SetOutput(out.output())
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"k1", "v1a,v1b"}, {"k2", "v2a,v2b"}}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("output = %v, want %v", got, want)
+	}
+}
+
+//TestLayerSpec runs layers with their own numbers of map and reduce workers
+//and small buffers, so that the workers of each phase wait on each other.
+func TestLayerSpec(t *testing.T) {
+	//countWorker counts the records seen by each map worker, so that each
+	//of them can be seen to have taken part.
+	countWorker := func(emitter Emitter) {
+		task := Task(emitter)
+		task.AddCounter(fmt.Sprintf("layer%d.worker%d", task.Layer(), task.Worker()), 1)
+	}
+	var pairs [][2]string
+	for i := range 100 {
+		pairs = append(pairs, [2]string{strconv.Itoa(i % 7), "1"})
+	}
+	m := Master{}
+	m.SetInput(pairInput(pairs...))
+	//The first layer counts the keys, and the second groups them by count.
+	m.AddLayer(LayerSpec{Job: Job{
+		Map: func(key string, value string, emitter Emitter) {
+			countWorker(emitter)
+			emitter.Emit(key, value)
+		},
+		Reduce: func(key string, values []string, emitter Emitter) {
+			emitter.Emit(key, strconv.Itoa(len(values)))
+		},
+	}, MapWorkers: 5, ReduceWorkers: 1, MapBuffer: 1, ReduceBuffer: 2})
+	m.AddLayer(LayerSpec{Job: Job{
+		Map: func(key string, value string, emitter Emitter) {
+			countWorker(emitter)
+			emitter.Emit(value, key)
+		},
+		Reduce: func(key string, values []string, emitter Emitter) {
+			slices.Sort(values)
+			emitter.Emit(key, strings.Join(values, ","))
+		},
+	}, MapWorkers: 3, ReduceWorkers: 3, MapBuffer: 1})
+	var out collector
+	m.SetOutput(out.output())
+	result, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"14", "2,3,4,5,6"}, {"15", "0,1"}}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("output = %v, want %v", got, want)
+	}
+	if progress := m.Progress(); progress.Workers != 12 || progress.FinishedWorkers != 12 {
+		t.Errorf("%d of %d workers finished, want 12 of 12", progress.FinishedWorkers, progress.Workers)
+	}
+	for layer, workers := range []int{5, 3} {
+		for worker := range workers {
+			if name := fmt.Sprintf("layer%d.worker%d", layer, worker); result.Counters[name] == 0 {
+				t.Errorf("map worker %d of layer %d received nothing", worker, layer)
+			}
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package datatypes
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+//shuffle collects the key-value pairs received by a reduce worker. Once the
+//buffered pairs exceed the memory budget, they are sorted by key and spilled
+//to a temporary file, and the files are merged when the reduce phase starts.
+//If valueLess is set, the values of each key are sorted as well. For a
+//TypedJob, typed orders the keys and values instead, by their typed pairs.
+type shuffle struct {
+	less      func(a, b string) bool
+	valueLess func(a, b string) bool
+	typed     *typedLayer
+	budget    int
+	baseDir   string
+	size      int
+	buffers   map[string][]entry
+	//fanIn is the number of spill files merged at once, see mergeSpills.
+	fanIn int
+
+	dir      string
+	spills   []string
+	numFiles int
+}
+
+//maxFanIn bounds the number of spill files a reduce worker has open at once.
+const maxFanIn = 64
+
+func newShuffle(less, valueLess func(a, b string) bool, budget int, baseDir string) *shuffle {
+	return &shuffle{less: keyOrder(less), valueLess: valueLess, budget: budget, baseDir: baseDir,
+		buffers: make(map[string][]entry), fanIn: maxFanIn}
+}
+
+//entry is a value held by the shuffle, along with the typed pair it encodes
+//for a TypedJob.
+type entry struct {
+	value string
+	pair  any
+}
+
+//values returns the values of the entries.
+func values(entries iter.Seq[entry]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for e := range entries {
+			if !yield(e.value) {
+				return
+			}
+		}
+	}
+}
+
+func entryValues(entries []entry) []string {
+	values := make([]string, len(entries))
+	for i, e := range entries {
+		values[i] = e.value
+	}
+	return values
+}
+
+//keyOrder extends a key comparator so that keys it considers equivalent are
+//still ordered, keeping identical keys next to each other.
+func keyOrder(less func(a, b string) bool) func(a, b string) bool {
+	if less == nil {
+		return func(a, b string) bool { return a < b }
+	}
+	return func(a, b string) bool {
+		if less(a, b) {
+			return true
+		} else if less(b, a) {
+			return false
+		}
+		return a < b
+	}
+}
+
+//add adds a value. The budget counts the encoded keys and values only, not
+//the typed pairs of a TypedJob.
+func (sh *shuffle) add(key string, e entry) error {
+	sh.buffers[key] = append(sh.buffers[key], e)
+	sh.size += len(key) + len(e.value)
+	if sh.budget > 0 && sh.size > sh.budget {
+		return sh.spill()
+	}
+	return nil
+}
+
+func (sh *shuffle) spill() error {
+	f, err := sh.create()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range sh.keys() {
+		for _, e := range sh.values(key) {
+			writeString(w, key)
+			writeString(w, e.value)
+		}
+	}
+	if err := closeFile(f, w); err != nil {
+		return err
+	}
+	sh.spills = append(sh.spills, f.Name())
+	sh.buffers = make(map[string][]entry)
+	sh.size = 0
+	return nil
+}
+
+//create creates a new spill file.
+func (sh *shuffle) create() (*os.File, error) {
+	if sh.dir == "" {
+		dir, err := os.MkdirTemp(sh.baseDir, "mapreduce-spill-")
+		if err != nil {
+			return nil, err
+		}
+		sh.dir = dir
+	}
+	sh.numFiles++
+	return os.Create(filepath.Join(sh.dir, strconv.Itoa(sh.numFiles)))
+}
+
+func closeFile(f *os.File, w *bufio.Writer) error {
+	err := w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sh *shuffle) keys() []string {
+	keys := make([]string, 0, len(sh.buffers))
+	for key := range sh.buffers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return sh.keyLess(keys[i], sh.buffers[keys[i]][0], keys[j], sh.buffers[keys[j]][0])
+	})
+	return keys
+}
+
+//values returns the values of a key, sorted in place if there is a value
+//comparator.
+func (sh *shuffle) values(key string) []entry {
+	values := sh.buffers[key]
+	if sh.sortsValues() {
+		sort.SliceStable(values, func(i, j int) bool { return sh.entryLess(values[i], values[j]) })
+	}
+	return values
+}
+
+//keyLess compares two keys, given one of the entries of each, which hold
+//the typed keys of a TypedJob. Keys that are equivalent are ordered by their
+//encoded form.
+func (sh *shuffle) keyLess(a string, ea entry, b string, eb entry) bool {
+	if sh.typed == nil || sh.typed.keyLess == nil || a == b {
+		return sh.less(a, b)
+	}
+	if sh.typed.keyLess(ea.pair, eb.pair) {
+		return true
+	} else if sh.typed.keyLess(eb.pair, ea.pair) {
+		return false
+	}
+	return a < b
+}
+
+func (sh *shuffle) sortsValues() bool {
+	if sh.typed != nil {
+		return sh.typed.valueLess != nil
+	}
+	return sh.valueLess != nil
+}
+
+//entryLess compares two values of a key, if sortsValues.
+func (sh *shuffle) entryLess(a, b entry) bool {
+	if sh.typed != nil {
+		return sh.typed.valueLess(a.pair, b.pair)
+	}
+	return sh.valueLess(a.value, b.value)
+}
+
+//each calls fn with every key, in order, and all of its values, until fn
+//returns false. If anything was spilled, the keys are merged from the spill
+//files and the remaining buffers, so each key is still seen exactly once,
+//and its values are streamed from the files rather than loaded into memory.
+//The values can only be iterated once, and only during the call to fn.
+func (sh *shuffle) each(fn func(key string, values iter.Seq[entry]) bool) error {
+	if len(sh.spills) == 0 {
+		for _, key := range sh.keys() {
+			if !fn(key, slices.Values(sh.values(key))) {
+				return nil
+			}
+		}
+		return nil
+	}
+	if err := sh.mergeSpills(); err != nil {
+		return err
+	}
+
+	var runs []*cursor
+	defer func() {
+		for _, c := range runs {
+			c.release()
+		}
+	}()
+	for i, name := range sh.spills {
+		c, err := sh.openRun(i, name)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, c)
+	}
+	keys := sh.keys()
+	for _, key := range keys {
+		sh.values(key)
+	}
+	k, v := 0, 0
+	runs = append(runs, &cursor{index: len(sh.spills), next: func() (string, entry, bool, error) {
+		if k == len(keys) {
+			return "", entry{}, false, nil
+		}
+		key, values := keys[k], sh.buffers[keys[k]]
+		value := values[v]
+		if v++; v == len(values) {
+			k, v = k+1, 0
+		}
+		return key, value, true, nil
+	}})
+
+	h, err := sh.newMergeHeap(runs)
+	if err != nil {
+		return err
+	}
+	for h.Len() > 0 && err == nil {
+		key := h.cursors[0].key
+		//next returns the next value of the key, or false once all of them
+		//have been seen.
+		next := func() (entry, bool) {
+			if err != nil || h.Len() == 0 || h.cursors[0].key != key {
+				return entry{}, false
+			}
+			value := h.cursors[0].value
+			err = h.advance()
+			return value, true
+		}
+		values := func(yield func(entry) bool) {
+			for value, ok := next(); ok; value, ok = next() {
+				if !yield(value) {
+					return
+				}
+			}
+		}
+		more := fn(key, values)
+		//Skip whatever values fn did not use.
+		for _, ok := next(); ok; _, ok = next() {
+		}
+		if !more {
+			break
+		}
+	}
+	return err
+}
+
+//mergeSpills merges the spill files fanIn at a time, over as many passes as
+//needed, until at most fanIn of them are left to be merged by each. Only
+//consecutive files are merged together, so the values of each key keep the
+//order in which they were received.
+func (sh *shuffle) mergeSpills() error {
+	for len(sh.spills) > sh.fanIn {
+		var merged []string
+		for i := 0; i < len(sh.spills); i += sh.fanIn {
+			group := sh.spills[i:min(i+sh.fanIn, len(sh.spills))]
+			if len(group) == 1 {
+				merged = append(merged, group[0])
+				continue
+			}
+			name, err := sh.mergeFiles(group)
+			if err != nil {
+				return err
+			}
+			merged = append(merged, name)
+		}
+		sh.spills = merged
+	}
+	return nil
+}
+
+//mergeFiles merges the spill files into a new one, and removes them.
+func (sh *shuffle) mergeFiles(names []string) (string, error) {
+	var runs []*cursor
+	defer func() {
+		for _, c := range runs {
+			c.release()
+		}
+	}()
+	for i, name := range names {
+		c, err := sh.openRun(i, name)
+		if err != nil {
+			return "", err
+		}
+		runs = append(runs, c)
+	}
+	h, err := sh.newMergeHeap(runs)
+	if err != nil {
+		return "", err
+	}
+	f, err := sh.create()
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for h.Len() > 0 && err == nil {
+		writeString(w, h.cursors[0].key)
+		writeString(w, h.cursors[0].value.value)
+		err = h.advance()
+	}
+	if cerr := closeFile(f, w); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+//close removes the spill files.
+func (sh *shuffle) close() error {
+	if sh.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(sh.dir)
+}
+
+//cursor is the current position in one sorted run of key-value pairs.
+type cursor struct {
+	index int
+	key   string
+	value entry
+	next  func() (key string, value entry, ok bool, err error)
+	//close closes the run's file, if it has one.
+	close func() error
+}
+
+//openRun opens a spill file as the run with the given index. The typed
+//pairs of a TypedJob are decoded as they are read back, once per pass.
+func (sh *shuffle) openRun(index int, name string) (*cursor, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	return &cursor{index: index, close: f.Close, next: func() (string, entry, bool, error) {
+		key, err := readString(r)
+		if err == io.EOF {
+			return "", entry{}, false, nil
+		} else if err != nil {
+			return "", entry{}, false, err
+		}
+		value, err := readString(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", entry{}, false, err
+		}
+		e := entry{value: value}
+		if sh.typed != nil {
+			if e.pair, err = sh.typed.pair([2]string{key, value}, nil); err != nil {
+				return "", entry{}, false, err
+			}
+		}
+		return key, e, true, nil
+	}}, nil
+}
+
+//advance moves the cursor on to the next pair of its run. The run's file is
+//closed as soon as it has been used up.
+func (c *cursor) advance() (bool, error) {
+	key, value, ok, err := c.next()
+	c.key, c.value = key, value
+	if !ok || err != nil {
+		if cerr := c.release(); err == nil {
+			err = cerr
+		}
+	}
+	return ok, err
+}
+
+//release closes the run's file, if it is still open.
+func (c *cursor) release() error {
+	if c.close == nil {
+		return nil
+	}
+	err := c.close()
+	c.close = nil
+	return err
+}
+
+//mergeHeap orders the cursors by key, then by value if there is a value
+//comparator, and then by run so that the values of a key otherwise keep the
+//order in which they were received.
+type mergeHeap struct {
+	sh      *shuffle
+	cursors []*cursor
+}
+
+//newMergeHeap moves every run on to its first pair, and builds a heap of
+//those that are not empty.
+func (sh *shuffle) newMergeHeap(runs []*cursor) (*mergeHeap, error) {
+	h := &mergeHeap{sh: sh}
+	for _, c := range runs {
+		ok, err := c.advance()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			h.cursors = append(h.cursors, c)
+		}
+	}
+	heap.Init(h)
+	return h, nil
+}
+
+//advance moves the first cursor on to its next pair, removing it from the
+//heap once its run has been used up.
+func (h *mergeHeap) advance() error {
+	ok, err := h.cursors[0].advance()
+	if ok {
+		heap.Fix(h, 0)
+	} else {
+		heap.Pop(h)
+	}
+	return err
+}
+
+func (h *mergeHeap) Len() int { return len(h.cursors) }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	if a.key != b.key {
+		return h.sh.keyLess(a.key, a.value, b.key, b.value)
+	}
+	if h.sh.sortsValues() {
+		if h.sh.entryLess(a.value, b.value) {
+			return true
+		} else if h.sh.entryLess(b.value, a.value) {
+			return false
+		}
+	}
+	return a.index < b.index
+}
+func (h *mergeHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *mergeHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*cursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	c := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return c
+}
+
+func writeString(w *bufio.Writer, s string) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+	w.WriteString(s)
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,175 @@
+package datatypes
+
+import (
+	"fmt"
+	"iter"
+	"os"
+	"slices"
+	"sort"
+	"testing"
+)
+
+//shuffleInput returns pairs whose keys repeat out of order, with values
+//recording the order in which they were added.
+func shuffleInput(n int) [][2]string {
+	var pairs [][2]string
+	for i := 0; i < n; i++ {
+		pairs = append(pairs, [2]string{fmt.Sprintf("k%02d", i*7%23), fmt.Sprintf("%04d", (n-i)*13%n)})
+	}
+	return pairs
+}
+
+//expected groups the pairs by key, in key order, keeping the values in the
+//order they were added unless sortValues is set.
+func expected(pairs [][2]string, sortValues bool) ([]string, map[string][]string) {
+	groups := make(map[string][]string)
+	for _, p := range pairs {
+		groups[p[0]] = append(groups[p[0]], p[1])
+	}
+	var keys []string
+	for key, values := range groups {
+		keys = append(keys, key)
+		if sortValues {
+			sort.Strings(values)
+		}
+	}
+	sort.Strings(keys)
+	return keys, groups
+}
+
+func openFiles(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open files")
+	}
+	return len(entries)
+}
+
+func TestShuffle(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     int
+		fanIn      int
+		sortValues bool
+	}{
+		{"in memory", 0, maxFanIn, false},
+		{"in memory sorted values", 0, maxFanIn, true},
+		{"spilled", 200, maxFanIn, false},
+		{"spilled sorted values", 200, maxFanIn, true},
+		{"multi-pass merge", 50, 3, false},
+		{"multi-pass merge sorted values", 50, 2, true},
+	}
+	pairs := shuffleInput(1000)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var valueLess func(a, b string) bool
+			if test.sortValues {
+				valueLess = func(a, b string) bool { return a < b }
+			}
+			sh := newShuffle(nil, valueLess, test.budget, t.TempDir())
+			sh.fanIn = test.fanIn
+			defer sh.close()
+			for _, p := range pairs {
+				if err := sh.add(p[0], entry{value: p[1]}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.budget > 0 && len(sh.spills) == 0 {
+				t.Fatal("nothing was spilled")
+			}
+			if test.fanIn < maxFanIn && len(sh.spills) <= test.fanIn {
+				t.Fatalf("only %d spill files, the test needs more than %d", len(sh.spills), test.fanIn)
+			}
+
+			files := openFiles(t)
+			wantKeys, wantValues := expected(pairs, test.sortValues)
+			var keys []string
+			err := sh.each(func(key string, entries iter.Seq[entry]) bool {
+				keys = append(keys, key)
+				if got := slices.Collect(values(entries)); !slices.Equal(got, wantValues[key]) {
+					t.Errorf("values of %q = %v, want %v", key, got, wantValues[key])
+				}
+				if test.budget > 0 && openFiles(t) > files+test.fanIn {
+					t.Errorf("%d files open while merging, at most %d expected", openFiles(t)-files, test.fanIn)
+				}
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(keys, wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, wantKeys)
+			}
+			if len(sh.spills) > test.fanIn {
+				t.Errorf("%d spill files merged at once, want at most %d", len(sh.spills), test.fanIn)
+			}
+			if open := openFiles(t); open != files {
+				t.Errorf("%d files left open", open-files)
+			}
+		})
+	}
+}
+
+//TestShuffleUnusedValues checks that values fn does not iterate, and keys
+//after fn stops, do not disturb the merge or leave files open.
+func TestShuffleUnusedValues(t *testing.T) {
+	pairs := shuffleInput(500)
+	sh := newShuffle(nil, nil, 100, t.TempDir())
+	defer sh.close()
+	for _, p := range pairs {
+		if err := sh.add(p[0], entry{value: p[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := openFiles(t)
+	wantKeys, wantValues := expected(pairs, false)
+	var keys []string
+	err := sh.each(func(key string, entries iter.Seq[entry]) bool {
+		keys = append(keys, key)
+		for value := range values(entries) {
+			if value != wantValues[key][0] {
+				t.Errorf("first value of %q = %q, want %q", key, value, wantValues[key][0])
+			}
+			break
+		}
+		return len(keys) < 5
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, wantKeys[:5]) {
+		t.Errorf("keys = %v, want %v", keys, wantKeys[:5])
+	}
+	if open := openFiles(t); open != files {
+		t.Errorf("%d files left open", open-files)
+	}
+}
+
+func TestShuffleKeyLess(t *testing.T) {
+	//Keys are ordered by length only, so keys of the same length are
+	//equivalent but must still be kept apart.
+	byLength := func(a, b string) bool { return len(a) < len(b) }
+	sh := newShuffle(byLength, nil, 10, t.TempDir())
+	defer sh.close()
+	for _, key := range []string{"bbb", "a", "cc", "aaa", "b", "a", "bbb"} {
+		if err := sh.add(key, entry{value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	err := sh.each(func(key string, entries iter.Seq[entry]) bool {
+		keys = append(keys, key)
+		for value := range values(entries) {
+			if value != key {
+				t.Errorf("value %q under key %q", value, key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "cc", "aaa", "bbb"}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+}
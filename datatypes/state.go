@@ -0,0 +1,150 @@
+package datatypes
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//state is shared by every goroutine taking part in a single run. It holds
+//the context used to stop the run and the errors reported so far.
+type state struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	name       string
+	params     map[string]string
+	baseDir    string
+	deadLetter chan message
+	outputs    map[string]chan message
+	sideInputs map[string]*SideInput
+	counters   counterSet
+	timings    timings
+	logger     *slog.Logger
+	start      time.Time
+	finished   atomic.Int64
+	done       atomic.Bool
+	//running counts the goroutines of the run, which must all have returned
+	//before the run does.
+	running sync.WaitGroup
+
+	mu            sync.Mutex
+	maxErrors     int
+	errs          []error
+	maxBadRecords int
+	badRecords    int
+}
+
+func newState(ctx context.Context, m *Master) *state {
+	s := &state{name: m.Name, params: maps.Clone(m.Params), baseDir: m.BaseDir, maxErrors: m.MaxErrors, maxBadRecords: m.MaxBadRecords, start: time.Now()}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.logger = m.logger
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.logger = s.logger.With("job", m.Name)
+	if m.deadLetter != nil {
+		s.deadLetter = m.deadLetter.inChannel
+	}
+	s.outputs = make(map[string]chan message)
+	for _, o := range m.outputs {
+		s.outputs[o.name] = o.inChannel
+	}
+	return s
+}
+
+//fail records an error, and aborts the run once more than maxErrors errors
+//have been recorded.
+func (s *state) fail(err error) {
+	s.log(slog.LevelError, "error", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) > s.maxErrors {
+		return
+	}
+	s.errs = append(s.errs, err)
+	if len(s.errs) > s.maxErrors {
+		s.cancel()
+	}
+}
+
+//abort records an error and aborts the run regardless of the error budget.
+func (s *state) abort(err error) {
+	s.log(slog.LevelError, "run aborted", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+	s.cancel()
+}
+
+//report records an error from a map or reduce function. If the function
+//panicked, or its records could not be decoded, the records it was given are
+//skipped instead.
+func (s *state) report(err error, records ...[2]string) {
+	var p *PanicError
+	var d *decodeError
+	if errors.As(err, &p) || errors.As(err, &d) {
+		s.skip(err, records)
+	} else {
+		s.fail(err)
+	}
+}
+
+//skip sends the records to the dead letter output, if there is one, and
+//aborts the run once more than maxBadRecords records have been skipped.
+func (s *state) skip(err error, records [][2]string) {
+	s.log(slog.LevelWarn, "records skipped", err, "records", len(records))
+	if s.deadLetter != nil {
+		for _, record := range records {
+			s.deadLetter <- message{kind: dataMessage, data: record}
+		}
+	}
+	s.mu.Lock()
+	s.badRecords++
+	over := s.badRecords > s.maxBadRecords
+	s.mu.Unlock()
+	if over {
+		s.abort(err)
+	}
+}
+
+func (s *state) skipped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.badRecords
+}
+
+//finish is called by every worker once it has ended its routes, and ends
+//the dead letter output and the named outputs as well.
+func (s *state) finish() {
+	s.finished.Add(1)
+	if s.deadLetter != nil {
+		end([]route{{channels: []chan message{s.deadLetter}}})
+	}
+	for _, outChannel := range s.outputs {
+		end([]route{{channels: []chan message{outChannel}}})
+	}
+}
+
+//log logs an error, tagged with where it occurred if it is a *JobError.
+func (s *state) log(level slog.Level, msg string, err error, args ...any) {
+	var je *JobError
+	if errors.As(err, &je) {
+		args = append(args, "phase", je.Phase)
+		if je.Layer >= 0 {
+			args = append(args, "layer", je.Layer, "worker", je.Worker, "key", je.Key)
+		}
+		err = je.Err
+	}
+	s.logger.Log(context.Background(), level, msg, append(args, "error", err)...)
+}
+
+func (s *state) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.errs...)
+}
@@ -0,0 +1,170 @@
+package datatypes
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+//TaskContext gives map and reduce functions access to the run they are part
+//of: where in the pipeline they are running, the job's name and parameters,
+//counters, a logger, the run's context and the side inputs. It is obtained
+//from the emitter passed to the function with Task.
+type TaskContext struct {
+	s      *state
+	stage  string
+	layer  int
+	phase  string
+	worker int
+	logger *slog.Logger
+}
+
+type tasker interface {
+	task() *TaskContext
+}
+
+func newTaskContext(s *state, stage string, layer int, phase string, worker int) *TaskContext {
+	logger := s.logger.With("stage", stage, "layer", layer, "phase", phase, "worker", worker)
+	return &TaskContext{s: s, stage: stage, layer: layer, phase: phase, worker: worker, logger: logger}
+}
+
+//Task returns the TaskContext of the worker, given the emitter passed to a
+//Map, Reduce or Combine function (or to the functions of a TypedJob), or to
+//GenInput, in which case the stage is the name of the input or side input.
+//Otherwise it returns a TaskContext that is not part of any run, whose
+//Layer and Worker are -1.
+func Task(emitter interface{}) *TaskContext {
+	if t, ok := emitter.(tasker); ok {
+		return t.task()
+	}
+	return &TaskContext{s: &state{ctx: context.Background()}, layer: -1, worker: -1, logger: slog.Default()}
+}
+
+//JobName returns the name of the Master running the function.
+func (t *TaskContext) JobName() string {
+	return t.s.name
+}
+
+//Stage returns the name of the stage running the function, e.g. "layer0".
+func (t *TaskContext) Stage() string {
+	return t.stage
+}
+
+//Layer returns the index of the layer running the function.
+func (t *TaskContext) Layer() int {
+	return t.layer
+}
+
+//Phase returns PhaseMap, PhaseCombine or PhaseReduce.
+func (t *TaskContext) Phase() string {
+	return t.phase
+}
+
+//Worker returns the index of the worker within its phase.
+func (t *TaskContext) Worker() int {
+	return t.worker
+}
+
+//Param returns the job parameter with the given name, see Master.Params.
+func (t *TaskContext) Param(name string) string {
+	return t.s.params[name]
+}
+
+//Params returns a copy of every job parameter.
+func (t *TaskContext) Params() map[string]string {
+	return maps.Clone(t.s.params)
+}
+
+//AddCounter adds delta to the named counter, which is returned with the
+//rest of the counters at the end of the run. Counters maintained by the
+//framework start with "layer" or "output".
+func (t *TaskContext) AddCounter(name string, delta int64) {
+	t.s.counters.add(name, delta)
+}
+
+//Logger returns the Master's logger, recording the job, stage, layer, phase
+//and worker with every message. See Master.SetLogger.
+func (t *TaskContext) Logger() *slog.Logger {
+	return t.logger
+}
+
+//Context returns the context of the run, which is done once the run is
+//cancelled or aborted. Long running functions should stop when it is done.
+func (t *TaskContext) Context() context.Context {
+	return t.s.ctx
+}
+
+//SideInput returns the side input added with Master.AddSideInput under the
+//given name, or nil if there is none.
+func (t *TaskContext) SideInput(name string) *SideInput {
+	return t.s.sideInputs[name]
+}
+
+//SideInput is a dataset, such as a lookup table, that is fully loaded before
+//the workers start and shared by all of them. It is read-only, so it is safe
+//to use from concurrent workers.
+type SideInput struct {
+	values map[string][]string
+}
+
+//sideInputLoader is the emitter used while loading a side input. Like an
+//Input, it drops the data once the run has been cancelled.
+type sideInputLoader struct {
+	si          *SideInput
+	taskContext *TaskContext
+}
+
+func (sl sideInputLoader) Emit(key string, value string) {
+	if sl.taskContext.s.ctx.Err() != nil {
+		return
+	}
+	sl.si.values[key] = append(sl.si.values[key], value)
+}
+
+func (sl sideInputLoader) task() *TaskContext {
+	return sl.taskContext
+}
+
+//Lookup returns the first value emitted for the key, and whether there was
+//one.
+func (si *SideInput) Lookup(key string) (string, bool) {
+	values := si.values[key]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+//Values returns a copy of every value emitted for the key.
+func (si *SideInput) Values(key string) []string {
+	return slices.Clone(si.values[key])
+}
+
+//Len returns the number of distinct keys.
+func (si *SideInput) Len() int {
+	return len(si.values)
+}
+
+//loadSideInputs runs each side input to completion, before anything else in
+//the run is started. It returns the context's error once the run is
+//cancelled, rather than a side input that may be incomplete.
+func loadSideInputs(s *state, inputs []*Input) (map[string]*SideInput, error) {
+	sideInputs := make(map[string]*SideInput)
+	for _, in := range inputs {
+		if err := s.ctx.Err(); err != nil {
+			return nil, err
+		}
+		si := &SideInput{values: make(map[string][]string)}
+		err := in.GenInputErr(in.Param, sideInputLoader{si: si, taskContext: newTaskContext(s, in.name, -1, PhaseInput, -1)})
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			return nil, &JobError{Layer: -1, Phase: PhaseInput, Worker: -1, Err: fmt.Errorf("side input %q: %w", in.name, err)}
+		}
+		sideInputs[in.name] = si
+	}
+	return sideInputs, nil
+}
@@ -0,0 +1,158 @@
+package datatypes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSideInput(t *testing.T) {
+	//names is loaded again on every run, from whatever the slice holds then.
+	names := [][2]string{{"1", "one"}, {"2", "two"}, {"2", "deux"}}
+	m := Master{}
+	m.SetInput(pairInput([2]string{"1", ""}, [2]string{"2", ""}, [2]string{"3", ""}))
+	m.AddSideInput("names", Input{GenInput: func(param string, emitter Emitter) {
+		for _, p := range names {
+			emitter.Emit(p[0], p[1])
+		}
+	}})
+	m.SetLayer(2, Job{Map: func(key string, value string, emitter Emitter) {
+		task := Task(emitter)
+		if task.SideInput("none") != nil {
+			panic("unknown side input found")
+		}
+		names := task.SideInput("names")
+		first, ok := names.Lookup(key)
+		emitter.Emit(key, fmt.Sprintf("%d %s %t %s", names.Len(), first, ok, strings.Join(names.Values(key), ",")))
+	}})
+	var out collector
+	m.SetOutput(out.output())
+
+	want := [][2]string{{"1", "2 one true one"}, {"2", "2 two true two,deux"}, {"3", "2  false "}}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	names = [][2]string{{"3", "three"}}
+	out.pairs = nil
+	want = [][2]string{{"1", "1  false "}, {"2", "1  false "}, {"3", "1 three true three"}}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("second run: output = %q, want %q", got, want)
+	}
+}
+
+//TestSideInputError checks that nothing is run if a side input fails to load.
+func TestSideInputError(t *testing.T) {
+	loadErr := errors.New("load failed")
+	started := false
+	m := Master{}
+	m.SetInput(Input{GenInput: func(param string, emitter Emitter) {
+		started = true
+	}})
+	m.AddSideInput("table", Input{GenInputErr: func(param string, emitter Emitter) error {
+		emitter.Emit("a", "1")
+		return loadErr
+	}})
+	m.SetLayer(1, Job{Map: identityMap})
+	m.SetOutput(Output{GenOutput: func(param, key, value string) {}})
+	_, err := m.Run()
+	var je *JobError
+	if !errors.Is(err, loadErr) || !errors.As(err, &je) || je.Phase != PhaseInput {
+		t.Errorf("Run() = %v, want the side input's error in the input phase", err)
+	}
+	if started {
+		t.Error("the input was started")
+	}
+}
+
+//TestSideInputContext checks that a side input is loaded with the run's task
+//context, and is not loaded once the run is cancelled.
+func TestSideInputContext(t *testing.T) {
+	var cancel context.CancelFunc
+	loaded := 0
+	m := Master{Name: "job", Params: map[string]string{"p": "v"}}
+	m.SetInput(pairInput([2]string{"k", ""}))
+	m.AddSideInput("table", Input{GenInput: func(param string, emitter Emitter) {
+		loaded++
+		task := Task(emitter)
+		emitter.Emit("k", fmt.Sprintf("%s %s %d %s %d %s", task.JobName(), task.Stage(), task.Layer(), task.Phase(), task.Worker(), task.Param("p")))
+		if cancel != nil {
+			cancel()
+			if task.Context().Err() == nil {
+				panic("the side input's context is not the run's")
+			}
+		}
+	}})
+	m.SetLayer(1, Job{Map: func(key string, value string, emitter Emitter) {
+		value, _ = Task(emitter).SideInput("table").Lookup(key)
+		emitter.Emit(key, value)
+	}})
+	var out collector
+	m.SetOutput(out.output())
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]string{{"k", "job table -1 input -1 v"}}; !slices.Equal(out.pairs, want) {
+		t.Errorf("output = %q, want %q", out.pairs, want)
+	}
+
+	//Cancelled while loading, and before.
+	out.pairs = nil
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	cancel = cancelCtx
+	for range 2 {
+		if _, err := m.RunContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("RunContext() = %v, want %v", err, context.Canceled)
+		}
+	}
+	if loaded != 2 || len(out.pairs) != 0 {
+		t.Errorf("side input loaded %d times with %q output, want 2 without output", loaded, out.pairs)
+	}
+}
+
+func TestTaskContext(t *testing.T) {
+	//describe emits where the function runs, and counts its calls.
+	describe := func(key string, emitter Emitter) {
+		task := Task(emitter)
+		task.AddCounter("calls", 1)
+		emitter.Emit(key, fmt.Sprintf("%s %s %d %s %d %s", task.JobName(), task.Stage(), task.Layer(), task.Phase(), task.Worker(), task.Param("p")))
+	}
+	m := Master{Name: "job", Params: map[string]string{"p": "v"}}
+	m.SetInput(pairInput([2]string{"k", ""}))
+	m.SetLayer(1, Job{Map: func(key string, value string, emitter Emitter) {
+		describe(key, emitter)
+	}})
+	m.SetLayer(1, Job{Reduce: func(key string, values []string, emitter Emitter) {
+		for _, value := range values {
+			emitter.Emit(key, value)
+		}
+		describe(key, emitter)
+	}})
+	var out collector
+	m.SetOutput(out.output())
+	result, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"k", "job layer0 0 map 0 v"}, {"k", "job layer1 1 reduce 0 v"}}
+	if got := out.sorted(); !slices.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if result.Counters["calls"] != 2 {
+		t.Errorf("calls = %d, want 2", result.Counters["calls"])
+	}
+
+	task := Task(nil)
+	if task.Layer() != -1 || task.Worker() != -1 || task.Context().Err() != nil || task.SideInput("names") != nil {
+		t.Errorf("Task(nil) is part of a run")
+	}
+}
@@ -0,0 +1,296 @@
+package datatypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+//Codec converts keys or values of type T to and from the strings that are
+//passed between layers.
+type Codec[T any] interface {
+	Encode(value T) (string, error)
+	Decode(data string) (T, error)
+}
+
+//StringCodec passes strings through unchanged.
+type StringCodec struct{}
+
+func (StringCodec) Encode(value string) (string, error) { return value, nil }
+func (StringCodec) Decode(data string) (string, error)  { return data, nil }
+
+//IntCodec encodes integers in decimal.
+type IntCodec struct{}
+
+func (IntCodec) Encode(value int) (string, error) { return strconv.Itoa(value), nil }
+func (IntCodec) Decode(data string) (int, error)  { return strconv.Atoi(data) }
+
+//JSONCodec encodes any type as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+func (JSONCodec[T]) Decode(data string) (T, error) {
+	var value T
+	err := json.Unmarshal([]byte(data), &value)
+	return value, err
+}
+
+//codecFor returns c, or the default codec for T if c is nil: StringCodec for
+//strings, IntCodec for ints and JSONCodec for everything else.
+func codecFor[T any](c Codec[T]) Codec[T] {
+	if c != nil {
+		return c
+	}
+	var zero T
+	switch any(zero).(type) {
+	case string:
+		return any(StringCodec{}).(Codec[T])
+	case int:
+		return any(IntCodec{}).(Codec[T])
+	}
+	return JSONCodec[T]{}
+}
+
+//TypedEmitter is the typed counterpart of Emitter.
+type TypedEmitter[K, V any] interface {
+	Emit(key K, value V)
+}
+
+//typedEmitter encodes the key-value pairs it is given. The first encoding
+//error is kept, to be returned by the function that was emitting.
+type typedEmitter[K, V any] struct {
+	emitter Emitter
+	keys    Codec[K]
+	values  Codec[V]
+	err     error
+}
+
+func (te *typedEmitter[K, V]) Emit(key K, value V) {
+	k, err := te.keys.Encode(key)
+	if err != nil {
+		te.fail(err)
+		return
+	}
+	v, err := te.values.Encode(value)
+	if err != nil {
+		te.fail(err)
+		return
+	}
+	if pe, ok := te.emitter.(pairEmitter); ok {
+		pe.emitPair(k, v, typedPair[K, V]{key, value})
+		return
+	}
+	te.emitter.Emit(k, v)
+}
+
+//pairEmitter is implemented by the workers, to send a TypedJob's typed pairs
+//along with their encoded form.
+type pairEmitter interface {
+	emitPair(key, value string, pair any)
+}
+
+//typedPair is a typed key and value, sent along with their encoded form
+//wherever a TypedJob's pairs are used without crossing a layer.
+type typedPair[K, V any] struct {
+	key   K
+	value V
+}
+
+//decodePair decodes a key-value pair, returning a *decodeError if it fails.
+func decodePair[K, V any](keys Codec[K], values Codec[V], data [2]string) (typedPair[K, V], error) {
+	var p typedPair[K, V]
+	var err error
+	if p.key, err = keys.Decode(data[0]); err != nil {
+		return p, &decodeError{"key", data[0], err}
+	}
+	if p.value, err = values.Decode(data[1]); err != nil {
+		return p, &decodeError{"value", data[1], err}
+	}
+	return p, nil
+}
+
+//decodeError is reported for a record whose key or value cannot be decoded.
+//Like a panic, it skips the record, see Master.MaxBadRecords.
+type decodeError struct {
+	what string
+	data string
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("cannot decode %s %q: %v", e.what, e.data, e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+func (te *typedEmitter[K, V]) source() string {
+	return Source(te.emitter)
+}
+
+func (te *typedEmitter[K, V]) emitTo(name, key, value string) error {
+	return EmitTo(te.emitter, name, key, value)
+}
+
+func (te *typedEmitter[K, V]) task() *TaskContext {
+	return Task(te.emitter)
+}
+
+func (te *typedEmitter[K, V]) fail(err error) {
+	if te.err == nil {
+		te.err = err
+	}
+}
+
+//TypedDistributor is the typed counterpart of Distributor.
+type TypedDistributor[K, V any] func(key K, value V, n int) int
+
+//TypedJob is a Job whose map function takes keys of type K1 and values of
+//type V1 and emits K2 and V2, and whose reduce function emits K3 and V3.
+//Either function may be left out, as for Job. The keys and values are encoded
+//with the codecs when they are passed between layers; a nil codec selects
+//the default for its type (see codecFor). Within a layer, the map function's
+//pairs reach the distributors, the comparators and the reduce function as
+//they were emitted. Their encoded form is still sent along with them, to
+//group the keys and to count, spill and skip the records, but it is only
+//decoded when read back from a spill file. Records that cannot be decoded
+//are skipped like records whose function panicked, see MaxBadRecords.
+//Unless KeyLess is set, keys are reduced in the order of their encoded form.
+//A TypedJob is added to a Master with SetLayer(num, typedJob.Job()).
+type TypedJob[K1, V1, K2, V2, K3, V3 any] struct {
+	Map    func(key K1, value V1, emitter TypedEmitter[K2, V2]) error
+	Reduce func(key K2, values []V2, emitter TypedEmitter[K3, V3]) error
+
+	InKey    Codec[K1]
+	InValue  Codec[V1]
+	MidKey   Codec[K2]
+	MidValue Codec[V2]
+	OutKey   Codec[K3]
+	OutValue Codec[V3]
+
+	//These are the typed counterparts of the Job fields of the same names.
+	MapDistribute TypedDistributor[K2, V2]
+	RedDistribute TypedDistributor[K3, V3]
+	KeyLess       func(a, b K2) bool
+	ValueLess     func(a, b V2) bool
+	ReduceMemory  int
+}
+
+//typedLayer is the part of a TypedJob's Job that works on its typed pairs.
+type typedLayer struct {
+	mapDistribute distributeFn
+	redDistribute distributeFn
+	//pair returns the typed pair of a record received by the reduce phase,
+	//decoding it only if it was not sent as one.
+	pair func(data [2]string, pair any) (any, error)
+	//keyLess and valueLess compare the keys and the values of two pairs, and
+	//are nil unless KeyLess and ValueLess are set.
+	keyLess   func(a, b any) bool
+	valueLess func(a, b any) bool
+	//reduce runs the Reduce function on the pairs of a key, and is nil if
+	//there is no Reduce function.
+	reduce func(entries []entry, emitter Emitter) error
+}
+
+//Job returns the Job that runs the typed functions. Its MapErr and ReduceErr
+//work on encoded strings, but the Master passes the typed pairs between the
+//phases of the layer instead, so the Job should be used as it is returned.
+func (tj TypedJob[K1, V1, K2, V2, K3, V3]) Job() Job {
+	inKey, inValue := codecFor(tj.InKey), codecFor(tj.InValue)
+	midKey, midValue := codecFor(tj.MidKey), codecFor(tj.MidValue)
+	outKey, outValue := codecFor(tj.OutKey), codecFor(tj.OutValue)
+
+	layer := &typedLayer{
+		mapDistribute: typedDistributor(tj.MapDistribute, midKey, midValue),
+		redDistribute: typedDistributor(tj.RedDistribute, outKey, outValue),
+		pair: func(data [2]string, pair any) (any, error) {
+			if p, ok := pair.(typedPair[K2, V2]); ok {
+				return p, nil
+			}
+			p, err := decodePair(midKey, midValue, data)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+	}
+	if tj.KeyLess != nil {
+		layer.keyLess = func(a, b any) bool {
+			return tj.KeyLess(a.(typedPair[K2, V2]).key, b.(typedPair[K2, V2]).key)
+		}
+	}
+	if tj.ValueLess != nil {
+		layer.valueLess = func(a, b any) bool {
+			return tj.ValueLess(a.(typedPair[K2, V2]).value, b.(typedPair[K2, V2]).value)
+		}
+	}
+	job := Job{ReduceMemory: tj.ReduceMemory, typed: layer}
+
+	if tj.Map != nil {
+		job.MapErr = func(key string, value string, emitter Emitter) error {
+			p, err := decodePair(inKey, inValue, [2]string{key, value})
+			if err != nil {
+				return err
+			}
+			te := &typedEmitter[K2, V2]{emitter: emitter, keys: midKey, values: midValue}
+			if err := tj.Map(p.key, p.value, te); err != nil {
+				return err
+			}
+			return te.err
+		}
+	}
+	if tj.Reduce != nil {
+		reduce := func(key K2, values []V2, emitter Emitter) error {
+			te := &typedEmitter[K3, V3]{emitter: emitter, keys: outKey, values: outValue}
+			if err := tj.Reduce(key, values, te); err != nil {
+				return err
+			}
+			return te.err
+		}
+		job.ReduceErr = func(key string, values []string, emitter Emitter) error {
+			var k K2
+			vs := make([]V2, len(values))
+			for i, value := range values {
+				p, err := decodePair(midKey, midValue, [2]string{key, value})
+				if err != nil {
+					return err
+				}
+				k, vs[i] = p.key, p.value
+			}
+			return reduce(k, vs, emitter)
+		}
+		layer.reduce = func(entries []entry, emitter Emitter) error {
+			values := make([]V2, len(entries))
+			for i, e := range entries {
+				values[i] = e.pair.(typedPair[K2, V2]).value
+			}
+			return reduce(entries[0].pair.(typedPair[K2, V2]).key, values, emitter)
+		}
+	}
+	return job
+}
+
+//typedDistributor returns the distributeFn of a typed distributor. The pairs
+//emitted by a TypedJob are sent along with their typed form, so they need
+//not be decoded. Otherwise a pair that cannot be decoded makes the
+//distributor panic, which skips it like any other bad record, since the
+//worker sending it recovers the panic.
+func typedDistributor[K, V any](distribute TypedDistributor[K, V], keys Codec[K], values Codec[V]) distributeFn {
+	if distribute == nil {
+		return nil
+	}
+	return func(data [2]string, pair any, n int) int {
+		p, ok := pair.(typedPair[K, V])
+		if !ok {
+			var err error
+			if p, err = decodePair(keys, values, data); err != nil {
+				panic(err)
+			}
+		}
+		return distribute(p.key, p.value, n)
+	}
+}
@@ -0,0 +1,196 @@
+package datatypes
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//countingCodec counts how often it decodes.
+type countingCodec struct {
+	IntCodec
+	decodes *atomic.Int64
+}
+
+func (c countingCodec) Decode(data string) (int, error) {
+	c.decodes.Add(1)
+	return c.IntCodec.Decode(data)
+}
+
+func TestTypedJob(t *testing.T) {
+	var input [][2]string
+	for i := 0; i < 200; i++ {
+		input = append(input, [2]string{strconv.Itoa(i), strconv.Itoa(i * 7 % 200)})
+	}
+	//Keys are reduced in descending order, and values in ascending order.
+	var want [][2]string
+	for key := 4; key >= 0; key-- {
+		var values []int
+		for _, p := range input {
+			if n, _ := strconv.Atoi(p[1]); n%5 == key {
+				values = append(values, n)
+			}
+		}
+		slices.Sort(values)
+		want = append(want, [2]string{strconv.Itoa(key), strings.Trim(fmt.Sprint(values), "[]")})
+	}
+
+	tests := []struct {
+		name   string
+		memory int
+		//maxDecodes is the most keys the reduce phase may decode.
+		maxDecodes int64
+	}{
+		{"in memory", 0, 0},
+		{"spilled", 300, int64(len(input))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decodes := new(atomic.Int64)
+			job := TypedJob[int, int, int, int, int, string]{
+				Map: func(key int, value int, emitter TypedEmitter[int, int]) error {
+					emitter.Emit(value%5, value)
+					return nil
+				},
+				Reduce: func(key int, values []int, emitter TypedEmitter[int, string]) error {
+					emitter.Emit(key, strings.Trim(fmt.Sprint(values), "[]"))
+					return nil
+				},
+				MidKey:       countingCodec{decodes: decodes},
+				KeyLess:      func(a, b int) bool { return a > b },
+				ValueLess:    func(a, b int) bool { return a < b },
+				ReduceMemory: test.memory,
+			}.Job()
+
+			var out collector
+			m := Master{BaseDir: t.TempDir()}
+			m.SetInput(pairInput(input...))
+			m.AddLayer(LayerSpec{Job: job, MapWorkers: 3, ReduceWorkers: 1})
+			m.SetOutput(out.output())
+			if _, err := m.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(out.pairs, want) {
+				t.Errorf("output = %v, want %v", out.pairs, want)
+			}
+			if n := decodes.Load(); n > test.maxDecodes {
+				t.Errorf("%d keys decoded, want at most %d", n, test.maxDecodes)
+			} else if test.memory > 0 && n == 0 {
+				t.Error("no keys decoded, so nothing was spilled")
+			}
+		})
+	}
+}
+
+//TestTypedJobBadRecords checks that records a TypedJob cannot decode are
+//skipped as bad records.
+func TestTypedJobBadRecords(t *testing.T) {
+	sum := TypedJob[string, int, string, int, string, int]{
+		Map: func(key string, value int, emitter TypedEmitter[string, int]) error {
+			emitter.Emit("sum", value)
+			return nil
+		},
+		Reduce: func(key string, values []int, emitter TypedEmitter[string, int]) error {
+			total := 0
+			for _, value := range values {
+				total += value
+			}
+			emitter.Emit(key, total)
+			return nil
+		},
+	}
+	reduceOnly := TypedJob[string, string, int, int, int, int]{
+		Reduce: func(key int, values []int, emitter TypedEmitter[int, int]) error {
+			emitter.Emit(key, len(values))
+			return nil
+		},
+	}
+	tests := []struct {
+		name    string
+		layers  []Job
+		input   [][2]string
+		want    [][2]string
+		letters [][2]string
+	}{
+		{
+			name:    "map input",
+			layers:  []Job{sum.Job()},
+			input:   [][2]string{{"a", "1"}, {"b", "x"}, {"c", "2"}},
+			want:    [][2]string{{"sum", "3"}},
+			letters: [][2]string{{"b", "x"}},
+		},
+		{
+			name:    "reduce input",
+			layers:  []Job{{Map: identityMap}, reduceOnly.Job()},
+			input:   [][2]string{{"1", "1"}, {"one", "1"}, {"1", "2"}},
+			want:    [][2]string{{"1", "2"}},
+			letters: [][2]string{{"one", "1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out, letters collector
+			m := Master{MaxBadRecords: 1}
+			m.SetInput(pairInput(test.input...))
+			for _, job := range test.layers {
+				m.SetLayer(2, job)
+			}
+			m.SetOutput(out.output())
+			m.SetDeadLetter(letters.output())
+			result, err := m.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(out.sorted(), test.want) {
+				t.Errorf("output = %v, want %v", out.pairs, test.want)
+			}
+			if !slices.Equal(letters.sorted(), test.letters) {
+				t.Errorf("dead letters = %v, want %v", letters.pairs, test.letters)
+			}
+			if result.BadRecords != 1 {
+				t.Errorf("BadRecords = %d, want 1", result.BadRecords)
+			}
+		})
+	}
+}
+
+func TestTypedDistributor(t *testing.T) {
+	job := TypedJob[string, int, int, int, int, int]{
+		Map: func(key string, value int, emitter TypedEmitter[int, int]) error {
+			emitter.Emit(value, value)
+			return nil
+		},
+		Reduce: func(key int, values []int, emitter TypedEmitter[int, int]) error {
+			emitter.Emit(key, Task(emitter).Worker())
+			return nil
+		},
+		//Even keys go to the first reduce worker, odd keys to the second.
+		MapDistribute: func(key int, value int, n int) int {
+			return key % n
+		},
+	}.Job()
+	var input [][2]string
+	for i := 0; i < 20; i++ {
+		input = append(input, [2]string{"", strconv.Itoa(i)})
+	}
+	var out collector
+	m := Master{}
+	m.SetInput(pairInput(input...))
+	m.AddLayer(LayerSpec{Job: job, MapWorkers: 2, ReduceWorkers: 2})
+	m.SetOutput(out.output())
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.pairs) != len(input) {
+		t.Fatalf("%d records written, want %d", len(out.pairs), len(input))
+	}
+	for _, p := range out.pairs {
+		key, _ := strconv.Atoi(p[0])
+		if worker, _ := strconv.Atoi(p[1]); worker != key%2 {
+			t.Errorf("key %d reduced by worker %d, want %d", key, worker, key%2)
+		}
+	}
+}
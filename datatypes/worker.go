@@ -1,80 +1,324 @@
 package datatypes
 
+import (
+	"errors"
+	"iter"
+	"slices"
+	"time"
+)
+
 //A worker is a single goroutine running a single map or reduce function.
-//It contains an input channel to listen on and a list of all of the channels
-//after it to send its data to.
+//It contains an input channel to listen on and a route for every set of
+//channels after it to send its data to.
 type worker interface {
-	run()
-	init(numUpstream int, inChannel chan [2]string, endpoints []chan [2]string)
+	run(s *state)
+	init(numUpstream int, inChannel chan message, routes []route)
+}
+
+//A phase is the set of workers running the map or the reduce function of a
+//layer, along with their input channels. buffer is the size of each channel,
+//and distribute is the distributor supplied by the user for the workers'
+//output, if any.
+type phase struct {
+	reduce     bool
+	workers    []worker
+	channels   []chan message
+	buffer     int
+	distribute distributeFn
+}
+
+const defaultBuffer = 100
+
+func (p *phase) bufferSize() int {
+	if p.buffer <= 0 {
+		return defaultBuffer
+	}
+	return p.buffer
 }
 
 type mapWorker struct {
+	stage       string
+	from        string
+	layer       int
+	index       int
 	numUpstream int
-	inChannel   chan [2]string
-	endpoints   []chan [2]string
-	distribute  Distributor
-	Map         MapFn
+	inChannel   chan message
+	routes      []route
+	outputs     map[string]chan message
+	taskContext *TaskContext
+	combineTask *TaskContext
+	counters    phaseCounters
+	started     time.Time
+	Map         MapErrFn
+
+	combine     RedFn
+	combineSize int
+	combined    map[string][]string
+	buffered    int
+	combineIn   int64
+	combineOut  int64
 }
 
 func (mw *mapWorker) Emit(key string, value string) {
-	mw.distribute([2]string{key, value}, mw.endpoints)
-}
-func (mw *mapWorker) run() {
-	for {
-		data := <-mw.inChannel
-		if data[0] == "\x00" {
-			mw.numUpstream--
-			if mw.numUpstream == 0 {
-				break
+	mw.emitPair(key, value, nil)
+}
+
+//emitPair emits the encoded form of a TypedJob's typed pair, which is sent
+//along with it unless it must be combined.
+func (mw *mapWorker) emitPair(key, value string, pair any) {
+	mw.counters.emitted(key, value)
+	if mw.combine != nil {
+		mw.combined[key] = append(mw.combined[key], value)
+		mw.buffered++
+		mw.combineIn++
+		return
+	}
+	send(mw.routes, mw.stage, [2]string{key, value}, pair)
+}
+
+//run stops mapping as soon as the context is done, but keeps draining its
+//channel until every upstream goroutine has finished.
+func (mw *mapWorker) run(s *state) {
+	mw.outputs = s.outputs
+	mw.taskContext = newTaskContext(s, mw.stage, mw.layer, PhaseMap, mw.index)
+	mw.combineTask = newTaskContext(s, mw.stage, mw.layer, PhaseCombine, mw.index)
+	mw.counters = newPhaseCounters(s, mw.layer, PhaseMap)
+	mw.taskContext.logger.Debug("worker started")
+	for mw.numUpstream > 0 {
+		select {
+		case msg := <-mw.inChannel:
+			if msg.kind == endMessage {
+				mw.numUpstream--
+				continue
+			}
+			if mw.started.IsZero() {
+				mw.started = time.Now()
+			}
+			mw.counters.received(msg.data)
+			mw.from = msg.source
+			if err := mw.process(msg.data[0], msg.data[1]); err != nil {
+				s.report(&JobError{Layer: mw.layer, Phase: PhaseMap, Worker: mw.index, Key: msg.data[0], Err: err}, msg.data)
+			}
+			if mw.buffered >= mw.combineSize {
+				mw.flush(s)
 			}
-			continue
+		case <-s.ctx.Done():
+			drain(mw.numUpstream, mw.inChannel)
+			mw.numUpstream = 0
 		}
-		mw.Map(data[0], data[1], mw)
 	}
-	end(mw.endpoints)
+	if mw.combine != nil {
+		mw.flush(s)
+		s.counters.add(layerCounter(mw.layer, "combine.in"), mw.combineIn)
+		s.counters.add(layerCounter(mw.layer, "combine.out"), mw.combineOut)
+	}
+	s.timings.record(layerCounter(mw.layer, PhaseMap), mw.started)
+	mw.taskContext.logger.Debug("worker finished")
+	end(mw.routes)
+	s.finish()
+}
+
+//flush runs the combine function on everything buffered so far.
+func (mw *mapWorker) flush(s *state) {
+	for key, values := range mw.combined {
+		if err := mw.combineKey(key, values); err != nil {
+			s.report(&JobError{Layer: mw.layer, Phase: PhaseCombine, Worker: mw.index, Key: key, Err: err}, pairs(key, values)...)
+		}
+	}
+	mw.combined = make(map[string][]string)
+	mw.buffered = 0
+}
+
+func (mw *mapWorker) combineKey(key string, values []string) (err error) {
+	defer recoverPanic(&err)
+	mw.combine(key, values, combineEmitter{mw})
+	return nil
+}
+
+//combineEmitter sends the output of the combine function on to the next
+//layer.
+type combineEmitter struct {
+	mw *mapWorker
+}
+
+func (ce combineEmitter) Emit(key string, value string) {
+	ce.mw.combineOut++
+	send(ce.mw.routes, ce.mw.stage, [2]string{key, value}, nil)
+}
+
+func (ce combineEmitter) emitTo(name, key, value string) error {
+	return ce.mw.emitTo(name, key, value)
+}
+
+func (ce combineEmitter) task() *TaskContext {
+	return ce.mw.combineTask
 }
 
-func (mw *mapWorker) init(numUpstream int, inChannel chan [2]string, endpoints []chan [2]string) {
+//source returns the name of the input or stage that sent the record being
+//mapped.
+func (mw *mapWorker) source() string {
+	return mw.from
+}
+
+func (mw *mapWorker) emitTo(name, key, value string) error {
+	return emitTo(mw.outputs, mw.stage, name, key, value)
+}
+
+func (mw *mapWorker) task() *TaskContext {
+	return mw.taskContext
+}
+
+//process runs the map function on a single record, recovering from a panic.
+func (mw *mapWorker) process(key string, value string) (err error) {
+	defer recoverPanic(&err)
+	return mw.Map(key, value, mw)
+}
+
+func (mw *mapWorker) init(numUpstream int, inChannel chan message, routes []route) {
 	mw.numUpstream = numUpstream
 	mw.inChannel = inChannel
-	mw.endpoints = endpoints
+	mw.routes = routes
+	mw.started = time.Time{}
+
+	mw.combined = make(map[string][]string)
+	mw.buffered = 0
+	mw.combineIn = 0
+	mw.combineOut = 0
 }
 
 type redWorker struct {
+	stage       string
+	layer       int
+	index       int
 	numUpstream int
-	inChannel   chan [2]string
-	endpoints   []chan [2]string
-	distribute  Distributor
-	Reduce      RedFn
+	inChannel   chan message
+	routes      []route
+	outputs     map[string]chan message
+	taskContext *TaskContext
+	counters    phaseCounters
+	started     time.Time
+	Reduce      RedErrFn
+	ReduceIter  RedIterFn
+	typed       *typedLayer
 
-	buffers map[string][]string
+	keyLess   func(a, b string) bool
+	valueLess func(a, b string) bool
+	memory    int
+	shuffle   *shuffle
 }
 
 func (rw *redWorker) Emit(key string, value string) {
-	rw.distribute([2]string{key, value}, rw.endpoints)
-}
-func (rw *redWorker) run() {
-	for {
-		data := <-rw.inChannel
-		if data[0] == "\x00" {
-			rw.numUpstream--
-			if rw.numUpstream == 0 {
-				break
+	rw.emitPair(key, value, nil)
+}
+
+func (rw *redWorker) emitPair(key, value string, pair any) {
+	rw.counters.emitted(key, value)
+	send(rw.routes, rw.stage, [2]string{key, value}, pair)
+}
+
+func (rw *redWorker) emitTo(name, key, value string) error {
+	return emitTo(rw.outputs, rw.stage, name, key, value)
+}
+
+func (rw *redWorker) task() *TaskContext {
+	return rw.taskContext
+}
+
+//run behaves like mapWorker.run, and additionally skips the remaining keys
+//if the context is done during the reduce phase.
+func (rw *redWorker) run(s *state) {
+	rw.outputs = s.outputs
+	rw.taskContext = newTaskContext(s, rw.stage, rw.layer, PhaseReduce, rw.index)
+	rw.counters = newPhaseCounters(s, rw.layer, PhaseReduce)
+	rw.taskContext.logger.Debug("worker started")
+	rw.shuffle = newShuffle(rw.keyLess, rw.valueLess, rw.memory, s.baseDir)
+	rw.shuffle.typed = rw.typed
+	for rw.numUpstream > 0 {
+		select {
+		case msg := <-rw.inChannel:
+			if msg.kind == endMessage {
+				rw.numUpstream--
+				continue
 			}
-			continue
+			if rw.started.IsZero() {
+				rw.started = time.Now()
+			}
+			rw.counters.received(msg.data)
+			e := entry{value: msg.data[1]}
+			if rw.typed != nil {
+				var err error
+				if e.pair, err = rw.typed.pair(msg.data, msg.pair); err != nil {
+					s.report(&JobError{Layer: rw.layer, Phase: PhaseReduce, Worker: rw.index, Key: msg.data[0], Err: err}, msg.data)
+					continue
+				}
+			}
+			if err := rw.shuffle.add(msg.data[0], e); err != nil {
+				s.abort(&JobError{Layer: rw.layer, Phase: PhaseReduce, Worker: rw.index, Key: msg.data[0], Err: err})
+				drain(rw.numUpstream, rw.inChannel)
+				rw.numUpstream = 0
+			}
+		case <-s.ctx.Done():
+			drain(rw.numUpstream, rw.inChannel)
+			rw.numUpstream = 0
+		}
+	}
+	err := rw.shuffle.each(func(key string, entries iter.Seq[entry]) bool {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		rw.counters.keys.Add(1)
+		//Streamed values cannot be replayed, so nothing is sent to the dead
+		//letter output for a key skipped by ReduceIter. It is counted
+		//instead.
+		var collected []entry
+		if rw.ReduceIter == nil {
+			collected = slices.Collect(entries)
+		}
+		if err := rw.process(key, entries, collected); err != nil {
+			var p *PanicError
+			if rw.ReduceIter != nil && errors.As(err, &p) {
+				s.counters.add(layerCounter(rw.layer, "reduce.streamed.skipped"), 1)
+			}
+			s.report(&JobError{Layer: rw.layer, Phase: PhaseReduce, Worker: rw.index, Key: key, Err: err}, pairs(key, entryValues(collected))...)
 		}
-		rw.buffers[data[0]] = append(rw.buffers[data[0]], data[1])
+		return true
+	})
+	if cerr := rw.shuffle.close(); err == nil {
+		err = cerr
 	}
-	for key, values := range rw.buffers {
-		rw.Reduce(key, values, rw)
+	if err != nil {
+		s.abort(&JobError{Layer: rw.layer, Phase: PhaseReduce, Worker: rw.index, Err: err})
 	}
-	end(rw.endpoints)
+	s.timings.record(layerCounter(rw.layer, PhaseReduce), rw.started)
+	rw.taskContext.logger.Debug("worker finished")
+	end(rw.routes)
+	s.finish()
 }
 
-func (rw *redWorker) init(numUpstream int, inChannel chan [2]string, endpoints []chan [2]string) {
+//process runs the reduce function on a single key, recovering from a panic.
+//Unless the values are streamed to ReduceIter, they have been collected.
+func (rw *redWorker) process(key string, entries iter.Seq[entry], collected []entry) (err error) {
+	defer recoverPanic(&err)
+	if rw.ReduceIter != nil {
+		return rw.ReduceIter(key, values(entries), rw)
+	} else if rw.typed != nil {
+		return rw.typed.reduce(collected, rw)
+	}
+	return rw.Reduce(key, entryValues(collected), rw)
+}
+
+//pairs returns a key-value pair for each of the values of a key.
+func pairs(key string, values []string) [][2]string {
+	records := make([][2]string, len(values))
+	for i, value := range values {
+		records[i] = [2]string{key, value}
+	}
+	return records
+}
+
+func (rw *redWorker) init(numUpstream int, inChannel chan message, routes []route) {
 	rw.numUpstream = numUpstream
 	rw.inChannel = inChannel
-	rw.endpoints = endpoints
-
-	rw.buffers = make(map[string][]string)
+	rw.routes = routes
+	rw.started = time.Time{}
 }
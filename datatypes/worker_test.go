@@ -0,0 +1,157 @@
+package datatypes
+
+import (
+	"errors"
+	"iter"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+//TestDeadLetter checks what a map or reduce function that panics sends to the
+//dead letter output, and when the skipped records abort the run.
+func TestDeadLetter(t *testing.T) {
+	//panicMap panics on the second value of the bad key.
+	panicMap := func(key string, value string, emitter Emitter) {
+		if key == "bad" && value == "2" {
+			panic("bad record")
+		}
+		emitter.Emit(key, value)
+	}
+	panicReduce := func(key string, values []string, emitter Emitter) {
+		if key == "bad" {
+			panic("bad key")
+		}
+		emitter.Emit(key, values[0])
+	}
+	tests := []struct {
+		name          string
+		job           Job
+		maxBadRecords int
+		//aborted is set if the run is aborted, and the output, dead letters
+		//and counter are then not checked.
+		aborted    bool
+		out        [][2]string
+		letters    [][2]string
+		badRecords int
+		counter    int64
+	}{
+		{
+			name:          "Map sends its record",
+			job:           Job{Map: panicMap},
+			maxBadRecords: 1,
+			out:           [][2]string{{"bad", "1"}, {"good", "1"}},
+			letters:       [][2]string{{"bad", "2"}},
+			badRecords:    1,
+		},
+		{
+			name:       "Map aborts over MaxBadRecords",
+			job:        Job{Map: panicMap},
+			aborted:    true,
+			badRecords: 1,
+		},
+		{
+			name:          "Reduce sends every value, and skips the key once",
+			job:           Job{Map: identityMap, Reduce: panicReduce},
+			maxBadRecords: 1,
+			out:           [][2]string{{"good", "1"}},
+			letters:       [][2]string{{"bad", "1"}, {"bad", "2"}},
+			badRecords:    1,
+		},
+		{
+			name:       "Reduce aborts over MaxBadRecords",
+			job:        Job{Map: identityMap, Reduce: panicReduce},
+			aborted:    true,
+			badRecords: 1,
+		},
+		{
+			name: "ReduceIter sends nothing",
+			job: Job{Map: identityMap, ReduceIter: func(key string, values iter.Seq[string], emitter Emitter) error {
+				for value := range values {
+					if key == "bad" {
+						panic("bad key")
+					}
+					emitter.Emit(key, value)
+					break
+				}
+				return nil
+			}},
+			maxBadRecords: 1,
+			out:           [][2]string{{"good", "1"}},
+			badRecords:    1,
+			counter:       1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out, letters collector
+			m := Master{MaxBadRecords: test.maxBadRecords}
+			m.SetInput(pairInput([2]string{"bad", "1"}, [2]string{"good", "1"}, [2]string{"bad", "2"}))
+			m.SetLayer(1, test.job)
+			m.SetOutput(out.output())
+			m.SetDeadLetter(letters.output())
+			result, err := m.Run()
+			if result.BadRecords != test.badRecords {
+				t.Errorf("BadRecords = %d, want %d", result.BadRecords, test.badRecords)
+			}
+			if test.aborted {
+				var p *PanicError
+				if !errors.As(err, &p) {
+					t.Errorf("Run() = %v, want a PanicError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.sorted(); !slices.Equal(got, test.out) {
+				t.Errorf("output = %v, want %v", got, test.out)
+			}
+			if !slices.Equal(letters.sorted(), test.letters) {
+				t.Errorf("dead letters = %v, want %v", letters.pairs, test.letters)
+			}
+			if got := result.Counters["layer0.reduce.streamed.skipped"]; got != test.counter {
+				t.Errorf("streamed.skipped = %d, want %d", got, test.counter)
+			}
+		})
+	}
+}
+
+//TestCombine checks that the combiner is run whenever CombineBuffer records
+//have been buffered, that a key combined in several flushes is still reduced
+//correctly, and that its counters start again on every run.
+func TestCombine(t *testing.T) {
+	sum := func(key string, values []string, emitter Emitter) {
+		total := 0
+		for _, value := range values {
+			n, _ := strconv.Atoi(value)
+			total += n
+		}
+		emitter.Emit(key, strconv.Itoa(total))
+	}
+	var pairs [][2]string
+	for i := range 10 {
+		pairs = append(pairs, [2]string{string(rune('a' + i%2)), "1"})
+	}
+	m := Master{}
+	m.SetInput(pairInput(pairs...))
+	m.SetLayer(1, Job{Map: identityMap, Combine: sum, Reduce: sum, CombineBuffer: 3})
+	var out collector
+	m.SetOutput(out.output())
+	for run := range 2 {
+		out.pairs = nil
+		result, err := m.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [][2]string{{"a", "5"}, {"b", "5"}}; !slices.Equal(out.sorted(), want) {
+			t.Errorf("run %d: output = %v, want %v", run, out.sorted(), want)
+		}
+		//The records are combined in flushes of a b a, b a b, a b a and b.
+		for counter, want := range map[string]int64{"layer0.combine.in": 10, "layer0.combine.out": 7, "layer0.reduce.in": 7} {
+			if got := result.Counters[counter]; got != want {
+				t.Errorf("run %d: %s = %d, want %d", run, counter, got, want)
+			}
+		}
+	}
+}
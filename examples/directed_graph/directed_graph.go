@@ -1,5 +1,6 @@
 //Package directed_graph contains an example for determining the cycles of length
-//three in a directed graph. This requires two MapReduce iterations.
+//three in a directed graph. This requires two MapReduce iterations, the second
+//of which only needs a Reduce function.
 package directed_graph
 
 import (
@@ -47,7 +48,8 @@ func ReduceGraph1(key string, values []string, emitter Emitter) {
 	}
 }
 
-//The second map iteration is the identity function
+//The second map iteration is the identity function. It is no longer needed,
+//since the second iteration can be a reduce-only layer.
 func MapGraph2(key string, value string, emitter Emitter) {
 	emitter.Emit(key, value)
 }
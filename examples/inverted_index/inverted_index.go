@@ -14,8 +14,15 @@ func MapIndex(key string, value string, emitter Emitter) {
 }
 
 //The reduce function outputs the value (now the key) and all of the keys that
-//were associated with that value
+//were associated with that value, sorted. Setting the Job's ValueLess to
+//SortKeys has the framework deliver them already sorted, which makes the
+//sort here almost free.
 func ReduceIndex(key string, values []string, emitter Emitter) {
 	sort.Strings(values)
 	emitter.Emit("", key+": "+strings.Join(values, ", "))
 }
+
+//SortKeys is the value comparator for ReduceIndex.
+func SortKeys(a, b string) bool {
+	return a < b
+}
@@ -0,0 +1,112 @@
+//Package join provides Jobs for joining two datasets by key. Reduce-side joins
+//take their datasets from two named inputs (or stages) connected to the layer,
+//and a broadcast join joins every record with a small dataset held in memory
+//as a side input.
+package join
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	d "mapreduce/datatypes"
+)
+
+//Kind is the kind of join to perform.
+type Kind int
+
+const (
+	//Inner joins only emit the keys found in both datasets.
+	Inner Kind = iota
+	//LeftOuter joins also emit the left values without a match.
+	LeftOuter
+	//FullOuter joins also emit the left and right values without a match.
+	FullOuter
+)
+
+//JoinFn is called for each pair of joined values of a key. For outer joins,
+//left or right is nil when the other value has no match.
+type JoinFn func(key string, left, right *string, emitter d.Emitter)
+
+//Values are tagged with a single leading byte recording their side. The tag
+//is always stripped before the value is used, so values may hold any bytes,
+//including the tags themselves.
+const (
+	leftTag  = '\x00'
+	rightTag = '\x01'
+)
+
+//Reduce returns a Job that joins the records of the inputs or stages named
+//left and right, which must both be connected to the layer running it. Every
+//left value of a key is held in memory while the right values are streamed,
+//so the larger dataset should be on the right.
+func Reduce(kind Kind, left, right string, fn JoinFn) d.Job {
+	return d.Job{
+		MapErr: func(key string, value string, emitter d.Emitter) error {
+			switch source := d.Source(emitter); source {
+			case left:
+				emitter.Emit(key, string(leftTag)+value)
+			case right:
+				emitter.Emit(key, string(rightTag)+value)
+			default:
+				return fmt.Errorf("join: record from unexpected source %q", source)
+			}
+			return nil
+		},
+		//Sorting by tag delivers the left values of each key first.
+		ValueLess: func(a, b string) bool {
+			return a[0] < b[0]
+		},
+		ReduceIter: func(key string, values iter.Seq[string], emitter d.Emitter) error {
+			var lefts []string
+			matched := false
+			for value := range values {
+				if value[0] == leftTag {
+					lefts = append(lefts, value[1:])
+					continue
+				}
+				right := value[1:]
+				if len(lefts) == 0 && kind == FullOuter {
+					fn(key, nil, &right, emitter)
+				}
+				for i := range lefts {
+					fn(key, &lefts[i], &right, emitter)
+				}
+				matched = true
+			}
+			if !matched && kind != Inner {
+				for i := range lefts {
+					fn(key, &lefts[i], nil, emitter)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+//Broadcast returns a map-only Job that joins every record, as the left value,
+//with the right values of its key in a small dataset: the side input added
+//to the Master with AddSideInput under the given name. The dataset is loaded
+//again at the start of every run, and shared by every map worker. A
+//broadcast join cannot be a full outer join, since the dataset's unmatched
+//keys are never seen, so an error is returned for FullOuter.
+func Broadcast(kind Kind, sideInput string, fn JoinFn) (d.Job, error) {
+	if kind != Inner && kind != LeftOuter {
+		return d.Job{}, errors.New("join: a broadcast join must be an inner or a left outer join")
+	}
+	return d.Job{
+		MapErr: func(key string, value string, emitter d.Emitter) error {
+			dataset := d.Task(emitter).SideInput(sideInput)
+			if dataset == nil {
+				return fmt.Errorf("join: no side input named %q", sideInput)
+			}
+			rights := dataset.Values(key)
+			if len(rights) == 0 && kind == LeftOuter {
+				fn(key, &value, nil, emitter)
+			}
+			for i := range rights {
+				fn(key, &value, &rights[i], emitter)
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,125 @@
+package join
+
+import (
+	"slices"
+	"sort"
+	"testing"
+
+	d "mapreduce/datatypes"
+)
+
+func pairInput(pairs ...[2]string) d.Input {
+	return d.Input{GenInput: func(param string, emitter d.Emitter) {
+		for _, p := range pairs {
+			emitter.Emit(p[0], p[1])
+		}
+	}}
+}
+
+//run runs m and returns its sorted output.
+func run(t *testing.T, m *d.Master) [][2]string {
+	t.Helper()
+	var out [][2]string
+	m.SetOutput(d.Output{GenOutput: func(param, key, value string) {
+		out = append(out, [2]string{key, value})
+	}})
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i][0] != out[j][0] {
+			return out[i][0] < out[j][0]
+		}
+		return out[i][1] < out[j][1]
+	})
+	return out
+}
+
+//pair emits both values of a joined pair, with "-" for a missing one.
+func pair(key string, left, right *string, emitter d.Emitter) {
+	value := func(v *string) string {
+		if v == nil {
+			return "-"
+		}
+		return *v
+	}
+	emitter.Emit(key, value(left)+"|"+value(right))
+}
+
+var (
+	//The values hold the tag bytes, which must survive the join.
+	lefts  = [][2]string{{"a", "l1"}, {"a", "\x01l2"}, {"b", "l3"}}
+	rights = [][2]string{{"a", "\x00r1"}, {"c", "r2"}}
+)
+
+func TestReduce(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		want [][2]string
+	}{
+		{Inner, [][2]string{{"a", "\x01l2|\x00r1"}, {"a", "l1|\x00r1"}}},
+		{LeftOuter, [][2]string{{"a", "\x01l2|\x00r1"}, {"a", "l1|\x00r1"}, {"b", "l3|-"}}},
+		{FullOuter, [][2]string{{"a", "\x01l2|\x00r1"}, {"a", "l1|\x00r1"}, {"b", "l3|-"}, {"c", "-|r2"}}},
+	}
+	for _, test := range tests {
+		m := &d.Master{}
+		m.AddInput("left", pairInput(lefts...))
+		m.AddInput("right", pairInput(rights...))
+		m.SetLayer(2, Reduce(test.kind, "left", "right", pair))
+		if got := run(t, m); !slices.Equal(got, test.want) {
+			t.Errorf("kind %d: output = %q, want %q", test.kind, got, test.want)
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		want [][2]string
+	}{
+		{Inner, [][2]string{{"a", "\x01l2|\x00r1"}, {"a", "l1|\x00r1"}}},
+		{LeftOuter, [][2]string{{"a", "\x01l2|\x00r1"}, {"a", "l1|\x00r1"}, {"b", "l3|-"}}},
+	}
+	for _, test := range tests {
+		job, err := Broadcast(test.kind, "right", pair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &d.Master{}
+		m.SetInput(pairInput(lefts...))
+		m.AddSideInput("right", pairInput(rights...))
+		m.SetLayer(2, job)
+		if got := run(t, m); !slices.Equal(got, test.want) {
+			t.Errorf("kind %d: output = %q, want %q", test.kind, got, test.want)
+		}
+	}
+
+	if _, err := Broadcast(FullOuter, "right", pair); err == nil {
+		t.Error("Broadcast(FullOuter) returned no error")
+	}
+}
+
+//TestBroadcastReload checks that the dataset is loaded again on every run,
+//rather than once for the life of the Job.
+func TestBroadcastReload(t *testing.T) {
+	job, err := Broadcast(Inner, "right", pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataset := [][2]string{{"a", "old"}}
+	m := &d.Master{}
+	m.SetInput(pairInput([2]string{"a", "l"}, [2]string{"b", "l"}))
+	m.AddSideInput("right", d.Input{GenInput: func(param string, emitter d.Emitter) {
+		for _, p := range dataset {
+			emitter.Emit(p[0], p[1])
+		}
+	}})
+	m.SetLayer(2, job)
+	if got, want := run(t, m), [][2]string{{"a", "l|old"}}; !slices.Equal(got, want) {
+		t.Errorf("first run: output = %q, want %q", got, want)
+	}
+	dataset = [][2]string{{"b", "new"}}
+	if got, want := run(t, m), [][2]string{{"b", "l|new"}}; !slices.Equal(got, want) {
+		t.Errorf("second run: output = %q, want %q", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	. "mapreduce/datatypes"
 	dg "mapreduce/examples/directed_graph"
 	ii "mapreduce/examples/inverted_index"
@@ -12,10 +13,24 @@ import (
 )
 
 var web = flag.Bool("w", false, "run web interface")
+var logFile = flag.String("log", "", "write JSON logs, including debug logs, to this file")
+var history = flag.String("history", ".mapreduce-history", "keep the history of web interface jobs in this directory, or nowhere if empty")
 
 func main() {
 	flag.Parse()
 
+	//Optionally log to a file, so that runs can be debugged after the fact
+	logger := slog.Default()
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Printf("Could not open log file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logger = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
 	if *web {
 		//Optionally specify default base directory
 		//If not set, the defaults in the web interface will be used
@@ -32,16 +47,26 @@ func main() {
 		}
 		
 		//Register jobs by name. This populates the drop-down menu
-		wi.RegisterJob("Inverted Index", Job{Map: ii.MapIndex, Reduce: ii.ReduceIndex})
+		wi.RegisterJob("Inverted Index", Job{Map: ii.MapIndex, Reduce: ii.ReduceIndex,
+			ValueLess: ii.SortKeys})
 		wi.RegisterJob("Directed Graph 1", Job{Map: dg.MapGraph1, Reduce: dg.ReduceGraph1,
 			RedDistribute: MakeHashDistributor()})
-		wi.RegisterJob("Directed Graph 2", Job{Map: dg.MapGraph2, Reduce: dg.ReduceGraph2})
+		wi.RegisterJob("Directed Graph 2", Job{Reduce: dg.ReduceGraph2})
 		
+		//Jobs started from the web interface log with the same logger
+		wi.Logger = logger
+
+		//Finished jobs are recorded in the history
+		wi.HistoryDir = *history
+
 		//Hostname and port can be changed freely
 		fmt.Printf("Web interface listening on: %s:%d\n", wi.Hostname, wi.Port)
 		
 		//Start the web interface
-		wi.Run()
+		if err := wi.Run(); err != nil {
+			fmt.Printf("Web interface failed: %v\n", err)
+			os.Exit(1)
+		}
 	} else {
 
 		//The default base directory is the current working directory
@@ -71,28 +96,33 @@ func main() {
 		inputLoc := baseDir + input
 		outputLoc := baseDir + output
 
-		master := Master{BaseDir: baseDir}
-		master.SetInput(Input{Param: inputLoc, GenInput: FileInput})
+		master := Master{Name: "Directed Graph", BaseDir: baseDir}
+		master.SetLogger(logger)
+		master.SetInput(Input{Param: inputLoc, GenInputErr: FileInputErr})
 
 		master.SetLayer(10, Job{Map: dg.MapGraph1, Reduce: dg.ReduceGraph1,
 			RedDistribute: MakeHashDistributor()})
-		master.SetLayer(10, Job{Map: dg.MapGraph2, Reduce: dg.ReduceGraph2})
+		master.SetLayer(10, Job{Reduce: dg.ReduceGraph2})
 
 		//These two "versions" are identical, they serve only to demonstrate
 		//two different ways of specifying output, using structs or closures
 		version := 2
 		if version == 1 {
 			//Struct
-			output := FileOutputStruct{}
+			output := FileOutputStruct{Logger: logger}
 			master.SetOutput(Output{Param: outputLoc, InitOutput: output.InitFileOutput, GenOutput: output.GenFileOutput, EndOutput: output.EndFileOutput})
 		} else if version == 2 {
 			//Closure. See datatypes/builtins.go
-			i, g, e := MakeFileOutput()
-			master.SetOutput(Output{Param: outputLoc, InitOutput: i, GenOutput: g, EndOutput: e})
+			i, g, e := MakeFileOutputErr()
+			master.SetOutput(Output{Param: outputLoc, InitOutputErr: i, GenOutputErr: g, EndOutputErr: e})
 		}
 
-		result := master.Run()
-		fmt.Printf("%d results written\n", result)
+		result, err := master.Run()
+		fmt.Printf("%d results written in %v\n", result.Records, result.Duration)
+		if err != nil {
+			fmt.Printf("Run failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 }
@@ -0,0 +1,192 @@
+package webinterface
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//APIVersion is the version of the JSON API. Its routes are served under a
+//versioned prefix, e.g. /api/v1/jobs, and under /api/ for the current version.
+const APIVersion = 1
+
+//CancelTimeout is how long a cancel request waits for the job to stop before
+//responding with 202 Accepted and the job's status so far.
+var CancelTimeout time.Duration = 10 * time.Second
+
+//apiRoute serves the JSON API:
+//	POST   /api/jobs       submits a job, see jobRequest
+//	GET    /api/jobs       lists every job
+//	GET    /api/jobs/{id}  returns the status of a job
+//	DELETE /api/jobs/{id}  removes a finished job from the registry
+//	POST   /api/jobs/{id}/cancel  cancels a running job, see apiCancel
+//	GET    /api/registry   lists the registered jobs, inputs and outputs, and
+//	                       the defaults
+func apiRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	path = strings.TrimPrefix(path, fmt.Sprintf("v%d/", APIVersion))
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "jobs":
+		switch r.Method {
+		case http.MethodPost:
+			apiSubmit(w, r)
+		case http.MethodGet:
+			apiJobs(w, r)
+		default:
+			apiMethodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) == 2 && parts[0] == "jobs":
+		j := lookupJob(parts[1])
+		if j == nil {
+			apiError(w, http.StatusNotFound, fmt.Sprintf("unknown job %q", parts[1]))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			apiJSON(w, http.StatusOK, j.status())
+		case http.MethodDelete:
+			apiDelete(w, j)
+		default:
+			apiMethodNotAllowed(w, "GET, DELETE")
+		}
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "cancel":
+		j := lookupJob(parts[1])
+		if j == nil {
+			apiError(w, http.StatusNotFound, fmt.Sprintf("unknown job %q", parts[1]))
+			return
+		}
+		if r.Method != http.MethodPost {
+			apiMethodNotAllowed(w, "POST")
+			return
+		}
+		apiCancel(w, r, j)
+	case len(parts) == 1 && parts[0] == "registry":
+		if r.Method != http.MethodGet {
+			apiMethodNotAllowed(w, "GET")
+			return
+		}
+		apiRegistry(w)
+	default:
+		apiError(w, http.StatusNotFound, "unknown API route")
+	}
+}
+
+func apiSubmit(w http.ResponseWriter, r *http.Request) {
+	var request jobRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+	if request.BaseDir == "" {
+		apiError(w, http.StatusBadRequest, "baseDir is required")
+		return
+	}
+	name, master, err := request.master()
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	j := startJob(name, master, request)
+	w.Header().Set("Location", fmt.Sprintf("/api/v%d/jobs/%d", APIVersion, j.id))
+	apiJSON(w, http.StatusCreated, j.status())
+}
+
+func apiJobs(w http.ResponseWriter, r *http.Request) {
+	statuses := []status{}
+	for _, j := range allJobs() {
+		statuses = append(statuses, j.status())
+	}
+	apiJSON(w, http.StatusOK, statuses)
+}
+
+//apiDelete removes a job from the registry. Running jobs cannot be removed.
+func apiDelete(w http.ResponseWriter, j *job) {
+	select {
+	case <-j.done:
+	default:
+		apiError(w, http.StatusConflict, fmt.Sprintf("job %d is still running", j.id))
+		return
+	}
+	registry.Lock()
+	delete(registry.jobs, j.id)
+	registry.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//apiCancel cancels a running job, and responds with its status once it has
+//stopped, including the number of records written before the stop. If the
+//job has not stopped within CancelTimeout, it responds with 202 Accepted and
+//the status so far instead, and the job can be polled until it has stopped.
+func apiCancel(w http.ResponseWriter, r *http.Request, j *job) {
+	if !j.stop() {
+		apiError(w, http.StatusConflict, fmt.Sprintf("job %d has already finished", j.id))
+		return
+	}
+	timeout := time.NewTimer(CancelTimeout)
+	defer timeout.Stop()
+	select {
+	case <-j.done:
+		apiJSON(w, http.StatusOK, j.status())
+	case <-timeout.C:
+		apiJSON(w, http.StatusAccepted, j.status())
+	case <-r.Context().Done():
+	}
+}
+
+func apiRegistry(w http.ResponseWriter) {
+	var names []string
+	for name := range jobMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var inputParams, outputParams []apiParam
+	for _, entry := range inputs {
+		inputParams = append(inputParams, apiParam{entry.name, entry.param.Description, entry.param.Path})
+	}
+	for _, entry := range outputs {
+		outputParams = append(outputParams, apiParam{entry.name, entry.param.Description, entry.param.Path})
+	}
+	apiJSON(w, http.StatusOK, struct {
+		Version int        `json:"version"`
+		Jobs    []string   `json:"jobs"`
+		Inputs  []apiParam `json:"inputs"`
+		Outputs []apiParam `json:"outputs"`
+		BaseDir string     `json:"baseDir"`
+		Input   string     `json:"input"`
+		Output  string     `json:"output"`
+		Workers int        `json:"workers"`
+	}{APIVersion, names, inputParams, outputParams, Base, Input, Output, Num})
+}
+
+//apiParam describes a registered input or output, see Param.
+type apiParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Path        bool   `json:"path"`
+}
+
+func apiJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		Logger.Error("could not write API response", "error", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, message string) {
+	apiJSON(w, code, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,234 @@
+package webinterface
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	d "mapreduce/datatypes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//gates holds the channels the "block" job and the "Stubborn" output wait on,
+//so that each test can end them once it is done with them by closing its own.
+var gates = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+func gate(name string) chan struct{} {
+	gates.Lock()
+	defer gates.Unlock()
+	return gates.m[name]
+}
+
+//setGate sets the channel named name, and returns it to be closed.
+func setGate(name string) chan struct{} {
+	gates.Lock()
+	defer gates.Unlock()
+	gates.m[name] = make(chan struct{})
+	return gates.m[name]
+}
+
+func init() {
+	Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	RegisterJob("identity", d.Job{Map: func(key string, value string, emitter d.Emitter) {
+		emitter.Emit(key, value)
+	}})
+	RegisterJob("block", d.Job{Map: func(key string, value string, emitter d.Emitter) {
+		select {
+		case <-gate("block"):
+		case <-d.Task(emitter).Context().Done():
+		}
+		emitter.Emit(key, value)
+	}})
+	RegisterInput("Test", Param{}, d.Input{GenInput: func(param string, emitter d.Emitter) {
+		emitter.Emit("a", "1")
+		emitter.Emit("b", "2")
+	}})
+	RegisterOutput("Discard", Param{}, func() d.Output {
+		return d.Output{GenOutput: func(param, key, value string) {}}
+	})
+	//Stubborn takes until its gate is closed to end, so its job does not stop
+	//in time when cancelled.
+	RegisterOutput("Stubborn", Param{}, func() d.Output {
+		stubborn := gate("stubborn")
+		return d.Output{GenOutput: func(param, key, value string) {}, EndOutput: func() { <-stubborn }}
+	})
+}
+
+func apiRequest(method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	apiRoute(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+//submitJob submits the named job, run on the test input, and returns its ID.
+func submitJob(t *testing.T, job, output string) int {
+	t.Helper()
+	body := fmt.Sprintf(`{"baseDir": %q, "inputType": "Test", "outputType": %q, "layers": [{"job": %q, "workers": 1}]}`, t.TempDir(), output, job)
+	w := apiRequest(http.MethodPost, "/api/v1/jobs", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("submit: status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var st status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("/api/v%d/jobs/%d", APIVersion, st.ID); w.Header().Get("Location") != want {
+		t.Errorf("Location = %q, want %q", w.Header().Get("Location"), want)
+	}
+	return st.ID
+}
+
+//waitMap waits for the map phase of the job to have received a record, so
+//that cancelling it stops it before it can finish.
+func waitMap(t *testing.T, id int) {
+	t.Helper()
+	j := lookupJob(fmt.Sprint(id))
+	for deadline := time.Now().Add(10 * time.Second); j.master.Progress().Counters["layer0.map.in"] == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d did not start", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//waitJob waits for the job to be done.
+func waitJob(t *testing.T, id int) {
+	t.Helper()
+	j := lookupJob(fmt.Sprint(id))
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("job %d did not finish", id)
+	}
+}
+
+func TestAPIRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"list jobs", http.MethodGet, "/api/jobs", "", http.StatusOK},
+		{"list jobs, versioned", http.MethodGet, "/api/v1/jobs/", "", http.StatusOK},
+		{"registry", http.MethodGet, "/api/registry", "", http.StatusOK},
+		{"unknown route", http.MethodGet, "/api/nothing", "", http.StatusNotFound},
+		{"unknown job", http.MethodGet, "/api/jobs/999", "", http.StatusNotFound},
+		{"invalid job ID", http.MethodGet, "/api/jobs/x", "", http.StatusNotFound},
+		{"cancel unknown job", http.MethodPost, "/api/jobs/999/cancel", "", http.StatusNotFound},
+		{"jobs method", http.MethodPut, "/api/jobs", "", http.StatusMethodNotAllowed},
+		{"registry method", http.MethodPost, "/api/registry", "", http.StatusMethodNotAllowed},
+		{"invalid JSON", http.MethodPost, "/api/jobs", "{", http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/api/jobs", `{"baseDir": "/tmp", "workers": 1}`, http.StatusBadRequest},
+		{"no base directory", http.MethodPost, "/api/jobs", `{"layers": [{"job": "identity", "workers": 1}]}`, http.StatusBadRequest},
+		{"no layers", http.MethodPost, "/api/jobs", `{"baseDir": "/tmp"}`, http.StatusBadRequest},
+		{"unregistered job", http.MethodPost, "/api/jobs", `{"baseDir": "/tmp", "layers": [{"job": "none", "workers": 1}]}`, http.StatusBadRequest},
+		{"no workers", http.MethodPost, "/api/jobs", `{"baseDir": "/tmp", "layers": [{"job": "identity"}]}`, http.StatusBadRequest},
+		{"unregistered input", http.MethodPost, "/api/jobs", `{"baseDir": "/tmp", "inputType": "none", "layers": [{"job": "identity", "workers": 1}]}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := apiRequest(test.method, test.path, test.body)
+			if w.Code != test.code {
+				t.Errorf("status %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+				t.Error("no Allow header")
+			}
+		})
+	}
+}
+
+//TestAPIJob follows a job from its submission to its removal.
+func TestAPIJob(t *testing.T) {
+	defer close(setGate("block"))
+	id := submitJob(t, "block", "Discard")
+	waitMap(t, id)
+	path := fmt.Sprintf("/api/jobs/%d", id)
+	steps := []struct {
+		method string
+		path   string
+		code   int
+		state  string
+	}{
+		{http.MethodGet, path, http.StatusOK, "running"},
+		{http.MethodDelete, path, http.StatusConflict, ""},
+		{http.MethodPut, path, http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, path + "/cancel", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, path + "/cancel", http.StatusOK, "cancelled"},
+		{http.MethodPost, path + "/cancel", http.StatusConflict, ""},
+		{http.MethodGet, path, http.StatusOK, "cancelled"},
+		{http.MethodDelete, path, http.StatusNoContent, ""},
+		{http.MethodGet, path, http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		w := apiRequest(step.method, step.path, "")
+		if w.Code != step.code {
+			t.Fatalf("%s %s: status %d, want %d: %s", step.method, step.path, w.Code, step.code, w.Body)
+		}
+		if step.state == "" {
+			continue
+		}
+		var st status
+		if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		if st.State != step.state {
+			t.Errorf("%s %s: state %q, want %q", step.method, step.path, st.State, step.state)
+		}
+	}
+}
+
+func TestAPIFinishedJob(t *testing.T) {
+	id := submitJob(t, "identity", "Discard")
+	waitJob(t, id)
+	w := apiRequest(http.MethodGet, fmt.Sprintf("/api/jobs/%d", id), "")
+	var st status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.State != "finished" || st.Running || st.Records != 2 {
+		t.Errorf("status = %+v, want finished with 2 records", st)
+	}
+	if w := apiRequest(http.MethodPost, fmt.Sprintf("/api/jobs/%d/cancel", id), ""); w.Code != http.StatusConflict {
+		t.Errorf("cancel: status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+//TestAPICancelTimeout checks that cancelling a job which does not stop in
+//time responds with 202 rather than blocking.
+func TestAPICancelTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { CancelTimeout = timeout }(CancelTimeout)
+	CancelTimeout = 10 * time.Millisecond
+
+	stubborn := setGate("stubborn")
+	unblock := setGate("block")
+	defer close(unblock)
+	id := submitJob(t, "block", "Stubborn")
+	waitMap(t, id)
+	w := apiRequest(http.MethodPost, fmt.Sprintf("/api/jobs/%d/cancel", id), "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var st status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if !st.Running {
+		t.Errorf("status = %+v, want the job still running", st)
+	}
+	close(stubborn)
+	waitJob(t, id)
+}
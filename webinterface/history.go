@@ -0,0 +1,286 @@
+package webinterface
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	d "mapreduce/datatypes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//HistoryDir is the directory in which a record of every finished job is
+//kept, one JSON file per job. The history is disabled if it is empty.
+var HistoryDir string
+
+//PreviewLines is the default number of lines of a job's output shown on its
+//history page.
+var PreviewLines int = 20
+
+//MaxPreviewLines is the most lines of a job's output shown on its history
+//page, however many the "lines" query parameter asks for.
+var MaxPreviewLines int = 1000
+
+//historyRecord is what is kept of a finished job.
+type historyRecord struct {
+	ID         int                      `json:"id"`
+	Name       string                   `json:"name"`
+	Request    jobRequest               `json:"request"`
+	State      string                   `json:"state"`
+	Error      string                   `json:"error,omitempty"`
+	Started    time.Time                `json:"started"`
+	Duration   time.Duration            `json:"duration"`
+	Records    int                      `json:"records"`
+	BadRecords int                      `json:"badRecords"`
+	Counters   d.Counters               `json:"counters"`
+	Timings    map[string]time.Duration `json:"timings"`
+	//OutputFile is the file the job wrote to, if its output has a path.
+	//OutputSize and OutputModified are its size and modification time once
+	//the job had finished, to tell whether it has changed since.
+	OutputFile     string    `json:"outputFile,omitempty"`
+	OutputSize     int64     `json:"outputSize,omitempty"`
+	OutputModified time.Time `json:"outputModified,omitzero"`
+}
+
+func historyFile(id int) string {
+	return filepath.Join(HistoryDir, fmt.Sprintf("%d.json", id))
+}
+
+//saveHistory records a finished job. The record is written to a temporary
+//file first, so that a record is never partially written.
+func saveHistory(j *job) error {
+	if HistoryDir == "" {
+		return nil
+	}
+	record := historyRecord{
+		ID:         j.id,
+		Name:       j.name,
+		Request:    j.request,
+		State:      j.state(),
+		Started:    j.started,
+		Duration:   j.result.Duration,
+		Records:    j.result.Records,
+		BadRecords: j.result.BadRecords,
+		Counters:   j.result.Counters,
+		Timings:    j.result.Timings,
+	}
+	if j.err != nil {
+		record.Error = j.err.Error()
+	}
+	if out, ok := lookupOutput(j.request.OutputType); ok && out.param.Path {
+		record.OutputFile = out.param.param(j.request.BaseDir, j.request.Output)
+		if info, err := os.Stat(record.OutputFile); err == nil {
+			record.OutputSize, record.OutputModified = info.Size(), info.ModTime()
+		}
+	}
+
+	data, err := json.MarshalIndent(record, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(HistoryDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(HistoryDir, ".record-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), historyFile(j.id))
+}
+
+func loadHistory(id int) (historyRecord, error) {
+	var record historyRecord
+	data, err := os.ReadFile(historyFile(id))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+//listHistory returns every record in the history, the most recent first.
+//Records that cannot be read, or that are not the record of the job their
+//file is named after, are logged and skipped, so that one bad file does not
+//hide the rest of the history.
+func listHistory() ([]historyRecord, error) {
+	if HistoryDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(HistoryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []historyRecord
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		record, err := loadHistory(id)
+		if err == nil && record.ID != id {
+			err = fmt.Errorf("record of job %d", record.ID)
+		}
+		if err != nil {
+			Logger.Warn("skipping history record", "file", historyFile(id), "error", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].ID > records[b].ID })
+	return records, nil
+}
+
+//initHistory continues the job IDs from the history, so that new jobs do not
+//overwrite the records of old ones.
+func initHistory() error {
+	records, err := listHistory()
+	if err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, record := range records {
+		if record.ID > registry.nextID {
+			registry.nextID = record.ID
+		}
+	}
+	return nil
+}
+
+//preview returns the first n lines of the file.
+func preview(file string, n int) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+//outputChanged returns whether the output file of the record is not the
+//one the job left, as far as its size and modification time tell. Records
+//without them are assumed to have changed.
+func outputChanged(record historyRecord) bool {
+	info, err := os.Stat(record.OutputFile)
+	return err != nil || info.Size() != record.OutputSize || !info.ModTime().Equal(record.OutputModified)
+}
+
+//historyList lists every job in the history.
+func historyList(w http.ResponseWriter, r *http.Request) {
+	records, err := listHistory()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read history: %v", err), 500)
+		return
+	}
+	output := "<html><body>\n<h3>History</h3>\n"
+	if HistoryDir == "" {
+		output += "<p>The history is disabled.</p>\n"
+	}
+	output += "<table>\n<tr><th>Job</th><th>State</th><th>Started</th><th>Duration</th><th>Records</th></tr>\n"
+	for _, record := range records {
+		output += fmt.Sprintf("<tr><td><a href=\"/history/%d\">Job %d: %s</a></td><td>%s</td><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			record.ID, record.ID, html.EscapeString(record.Name), record.State,
+			record.Started.Format(time.DateTime), record.Duration.Round(time.Millisecond), record.Records)
+	}
+	output += "</table>\n<a href=\"/jobs\">Current jobs</a> <a href=\"/\">New job</a>\n</body></html>"
+	fmt.Fprintln(w, output)
+}
+
+//historyPage shows a job's record, and a preview of its output file. The
+//number of lines previewed can be set with the "lines" query parameter, up to
+//MaxPreviewLines. The output file is read when the page is shown, so the
+//preview is flagged if the file has changed since the job finished.
+func historyPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/history/"))
+	if err != nil || HistoryDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	record, err := loadHistory(id)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read history: %v", err), 500)
+		return
+	}
+	n := PreviewLines
+	if lines := r.URL.Query().Get("lines"); lines != "" {
+		if n, err = strconv.Atoi(lines); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Illegal 'lines': %s", lines), 400)
+			return
+		}
+	}
+	n = min(n, MaxPreviewLines)
+
+	var buffer strings.Builder
+	fmt.Fprintf(&buffer, "State: %s\n", record.State)
+	if record.Error != "" {
+		fmt.Fprintf(&buffer, "Error: %s\n", record.Error)
+	}
+	fmt.Fprintf(&buffer, "Started: %s\nDuration: %s\n", record.Started.Format(time.DateTime), record.Duration)
+	fmt.Fprintf(&buffer, "Records written: %d\nBad records: %d\n", record.Records, record.BadRecords)
+	fmt.Fprintf(&buffer, "Base directory: %s\n", record.Request.BaseDir)
+	fmt.Fprintf(&buffer, "Input: %s %s\n", record.Request.InputType, record.Request.Input)
+	fmt.Fprintf(&buffer, "Output: %s %s\n", record.Request.OutputType, record.Request.Output)
+	for i, l := range record.Request.Layers {
+		fmt.Fprintf(&buffer, "Layer %d: %s, %d workers\n", i, l.Job, l.Workers)
+	}
+	buffer.WriteString("\nCounters:\n")
+	var names []string
+	for name := range record.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "  %s: %d\n", name, record.Counters[name])
+	}
+	buffer.WriteString("\nTimings:\n")
+	names = names[:0]
+	for name := range record.Timings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "  %s: %s\n", name, record.Timings[name])
+	}
+
+	output := "<html><body>\n<h3>Job " + strconv.Itoa(record.ID) + ": " + html.EscapeString(record.Name) + "</h3>\n"
+	output += "<pre>" + html.EscapeString(buffer.String()) + "</pre>\n"
+	if record.OutputFile != "" && record.State == "finished" {
+		lines, err := preview(record.OutputFile, n)
+		output += fmt.Sprintf("<h4>First %d lines of %s</h4>\n", n, html.EscapeString(record.OutputFile))
+		if err == nil && outputChanged(record) {
+			output += "<p>The output file has changed since the job finished, so this is not necessarily what it wrote.</p>\n"
+		}
+		if err != nil {
+			output += "<p>Could not read the output: " + html.EscapeString(err.Error()) + "</p>\n"
+		} else {
+			output += "<pre>" + html.EscapeString(strings.Join(lines, "\n")) + "</pre>\n"
+		}
+	}
+	output += "<a href=\"/history\">History</a> <a href=\"/\">New job</a>\n</body></html>"
+	fmt.Fprintln(w, output)
+}
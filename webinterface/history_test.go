@@ -0,0 +1,162 @@
+package webinterface
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestMain keeps the history of every job of the tests in one directory. It
+//is not changed between tests, since jobs are recorded after they are done.
+//The records written by the tests themselves have IDs from 1000 on, so as
+//not to clash with those of the jobs.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "history")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	HistoryDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func writeRecord(t *testing.T, name string, record historyRecord) {
+	t.Helper()
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(HistoryDir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//TestListHistory checks that files which are not good records are skipped,
+//rather than making the whole history unreadable.
+func TestListHistory(t *testing.T) {
+	writeRecord(t, "1001.json", historyRecord{ID: 1001})
+	writeRecord(t, "1003.json", historyRecord{ID: 1003})
+	writeRecord(t, "1004.json", historyRecord{ID: 1002})
+	writeRecord(t, "notes.json", historyRecord{ID: 1005})
+	os.WriteFile(filepath.Join(HistoryDir, "1002.json"), []byte("{"), 0644)
+	os.WriteFile(filepath.Join(HistoryDir, "1006.txt"), []byte("{}"), 0644)
+	os.Mkdir(filepath.Join(HistoryDir, "1007.json"), 0755)
+
+	records, err := listHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, record := range records {
+		if record.ID >= 1000 && record.ID < 2000 {
+			ids = append(ids, record.ID)
+		}
+	}
+	if want := []int{1003, 1001}; !slices.Equal(ids, want) {
+		t.Errorf("IDs = %v, want %v", ids, want)
+	}
+
+	w := httptest.NewRecorder()
+	historyList(w, httptest.NewRequest(http.MethodGet, "/history", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/history: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestHistoryPage(t *testing.T) {
+	defer func(n int) { MaxPreviewLines = n }(MaxPreviewLines)
+	MaxPreviewLines = 5
+
+	output := filepath.Join(t.TempDir(), "output.txt")
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprint("line ", i))
+	}
+	if err := os.WriteFile(output, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecord(t, "2001.json", historyRecord{ID: 2001, State: "finished", OutputFile: output, OutputSize: info.Size(), OutputModified: info.ModTime()})
+	writeRecord(t, "2002.json", historyRecord{ID: 2002, State: "finished", OutputFile: output})
+
+	tests := []struct {
+		name    string
+		path    string
+		code    int
+		want    []string
+		notWant []string
+	}{
+		{"lines", "/history/2001?lines=2", http.StatusOK, []string{"First 2 lines", "line 1"}, []string{"line 2", "has changed"}},
+		{"lines clamped", "/history/2001?lines=1000000000", http.StatusOK, []string{"First 5 lines", "line 4"}, []string{"line 5"}},
+		{"output changed", "/history/2002", http.StatusOK, []string{"has changed"}, nil},
+		{"illegal lines", "/history/2001?lines=x", http.StatusBadRequest, nil, nil},
+		{"negative lines", "/history/2001?lines=-1", http.StatusBadRequest, nil, nil},
+		{"unknown job", "/history/2003", http.StatusNotFound, nil, nil},
+		{"invalid ID", "/history/x", http.StatusNotFound, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			historyPage(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("page does not contain %q:\n%s", want, w.Body)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(w.Body.String(), notWant) {
+					t.Errorf("page contains %q:\n%s", notWant, w.Body)
+				}
+			}
+		})
+	}
+}
+
+//TestSaveHistory checks that a finished job is recorded, along with the
+//state of its output file.
+func TestSaveHistory(t *testing.T) {
+	base := t.TempDir()
+	body := fmt.Sprintf(`{"baseDir": %q, "inputType": "Test", "output": "out.txt", "layers": [{"job": "identity", "workers": 1}]}`, base)
+	w := apiRequest(http.MethodPost, "/api/jobs", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("submit: status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var st status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, st.ID)
+
+	//The record is saved once the job is done.
+	var record historyRecord
+	var err error
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		if record, err = loadHistory(st.ID); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != "finished" || record.Records != 2 || record.OutputFile != filepath.Join(base, "out.txt") {
+		t.Errorf("record = %+v, want a finished job with 2 records written to out.txt", record)
+	}
+	if outputChanged(record) {
+		t.Error("output reported as changed")
+	}
+}
@@ -0,0 +1,273 @@
+package webinterface
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	d "mapreduce/datatypes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//A job is a Master submitted through the web interface.
+type job struct {
+	id      int
+	name    string
+	started time.Time
+	master  *d.Master
+	request jobRequest
+	done    chan struct{}
+	//cancel stops the job, and cancelled records that it was called.
+	cancel    context.CancelFunc
+	cancelled atomic.Bool
+
+	//result and err are set once done is closed.
+	result d.RunResult
+	err    error
+}
+
+//registry tracks every job submitted since the web interface started.
+var registry = struct {
+	sync.Mutex
+	jobs   map[int]*job
+	nextID int
+}{jobs: make(map[int]*job)}
+
+//startJob registers the master as a new job and runs it. Once it is done,
+//it is recorded in the history, see HistoryDir.
+func startJob(name string, master *d.Master, request jobRequest) *job {
+	registry.Lock()
+	registry.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{id: registry.nextID, name: name, started: time.Now(), master: master, request: request, done: make(chan struct{}), cancel: cancel}
+	registry.jobs[j.id] = j
+	registry.Unlock()
+
+	go func() {
+		defer cancel()
+		j.result, j.err = master.RunContext(ctx)
+		if j.stopped() {
+			Logger.Info("job cancelled", "job", name, "id", j.id, "records", j.result.Records)
+		} else if j.err != nil {
+			Logger.Error("job failed", "job", name, "id", j.id, "error", j.err)
+		}
+		close(j.done)
+		if err := saveHistory(j); err != nil {
+			Logger.Error("could not record job history", "job", name, "id", j.id, "error", err)
+		}
+	}()
+	return j
+}
+
+//allJobs returns every job in the registry, in the order they were started.
+func allJobs() []*job {
+	registry.Lock()
+	defer registry.Unlock()
+	jobs := make([]*job, 0, len(registry.jobs))
+	for id := 1; id <= registry.nextID; id++ {
+		if j, ok := registry.jobs[id]; ok {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+func lookupJob(idString string) *job {
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		return nil
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.jobs[id]
+}
+
+//stop cancels the job, stopping its input, workers and output. It returns
+//false if the job had already finished.
+func (j *job) stop() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+	}
+	j.cancelled.Store(true)
+	j.cancel()
+	return true
+}
+
+//stopped returns whether the job ended because it was cancelled, once it
+//has ended.
+func (j *job) stopped() bool {
+	return j.cancelled.Load() && errors.Is(j.err, context.Canceled)
+}
+
+//state returns "running", "finished", "failed" or "cancelled". A job is
+//only cancelled if it was stopped before it finished by itself.
+func (j *job) state() string {
+	select {
+	case <-j.done:
+	default:
+		return "running"
+	}
+	if j.stopped() {
+		return "cancelled"
+	} else if j.err != nil {
+		return "failed"
+	}
+	return "finished"
+}
+
+//jobRoute serves /jobs/{id}, /jobs/{id}/events and /jobs/{id}/cancel.
+func jobRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	j := lookupJob(path[0])
+	if j == nil {
+		http.NotFound(w, r)
+	} else if len(path) == 1 {
+		jobPage(w, r, j)
+	} else if len(path) == 2 && path[1] == "events" {
+		jobEvents(w, r, j)
+	} else if len(path) == 2 && path[1] == "cancel" && r.Method == http.MethodPost {
+		j.stop()
+		http.Redirect(w, r, fmt.Sprintf("/jobs/%d", j.id), 303)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+//status is the JSON form of a job's progress, sent to the status page.
+type status struct {
+	ID       int            `json:"id"`
+	Name     string         `json:"name"`
+	Running  bool           `json:"running"`
+	State    string         `json:"state"`
+	Elapsed  string         `json:"elapsed"`
+	Counters d.Counters     `json:"counters"`
+	Backlog  map[string]int `json:"backlog"`
+	Finished int            `json:"finishedWorkers"`
+	Workers  int            `json:"workers"`
+	Records  int            `json:"records"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func (j *job) status() status {
+	progress := j.master.Progress()
+	st := status{
+		ID:       j.id,
+		Name:     j.name,
+		Running:  true,
+		Elapsed:  time.Since(j.started).Round(time.Millisecond).String(),
+		Counters: progress.Counters,
+		Backlog:  progress.Backlog,
+		Finished: progress.FinishedWorkers,
+		Workers:  progress.Workers,
+	}
+	st.State = j.state()
+	select {
+	case <-j.done:
+		st.Running = false
+		st.Elapsed = j.result.Duration.Round(time.Millisecond).String()
+		st.Counters = j.result.Counters
+		st.Records = j.result.Records
+		if j.err != nil {
+			st.Error = j.err.Error()
+		}
+	default:
+	}
+	return st
+}
+
+//jobEvents streams the job's status as Server-Sent Events until it is done.
+func jobEvents(w http.ResponseWriter, r *http.Request, j *job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		st := j.status()
+		data, err := json.Marshal(st)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		if !st.Running {
+			fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-j.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+//jobPage shows the status of a job, updated from jobEvents.
+func jobPage(w http.ResponseWriter, r *http.Request, j *job) {
+	output := `<html><head>
+<script>
+var source = new EventSource('/jobs/` + strconv.Itoa(j.id) + `/events');
+source.onmessage = function(e) {
+	var st = JSON.parse(e.data);
+	var text = st.state.charAt(0).toUpperCase() + st.state.slice(1) + ' after ' + st.elapsed + '\n';
+	text += 'Workers finished: ' + st.finishedWorkers + ' of ' + st.workers + '\n';
+	if (!st.running) {
+		text += 'Records written: ' + st.records + '\n';
+	}
+	if (st.error) {
+		text += 'Error: ' + st.error + '\n';
+	}
+	text += '\nCounters:\n';
+	Object.keys(st.counters || {}).sort().forEach(function(name) {
+		text += '  ' + name + ': ' + st.counters[name] + '\n';
+	});
+	text += '\nBacklog:\n';
+	Object.keys(st.backlog || {}).sort().forEach(function(name) {
+		text += '  ' + name + ': ' + st.backlog[name] + '\n';
+	});
+	document.getElementById('status').textContent = text;
+	if (!st.running) {
+		document.getElementById('cancel').style.display = 'none';
+	}
+};
+source.addEventListener('done', function() {
+	source.close();
+});
+</script>
+</head><body>
+<h3>Job ` + strconv.Itoa(j.id) + `: ` + html.EscapeString(j.name) + `</h3>
+<pre id="status">Waiting for progress...</pre>
+<form id="cancel" action="/jobs/` + strconv.Itoa(j.id) + `/cancel" method="post">
+<input type="submit" value="Cancel">
+</form>
+<a href="/jobs">All jobs</a> <a href="/history">History</a> <a href="/">New job</a>
+</body></html>`
+	fmt.Fprintln(w, output)
+}
+
+//jobList lists every job in the registry.
+func jobList(w http.ResponseWriter, r *http.Request) {
+	jobs := allJobs()
+	output := "<html><body>\n<h3>Jobs</h3>\n<ul>\n"
+	for _, j := range jobs {
+		output += fmt.Sprintf("<li><a href=\"/jobs/%d\">Job %d: %s</a> (%s, started %s)</li>\n",
+			j.id, j.id, html.EscapeString(j.name), j.state(), j.started.Format(time.TimeOnly))
+	}
+	output += "</ul>\n<a href=\"/history\">History</a> <a href=\"/\">New job</a>\n</body></html>"
+	fmt.Fprintln(w, output)
+}
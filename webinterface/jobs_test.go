@@ -0,0 +1,69 @@
+package webinterface
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//TestJobEvents reads the events of a job from while it runs until it is
+//done, and checks the status they carry.
+func TestJobEvents(t *testing.T) {
+	unblock := setGate("block")
+	id := submitJob(t, "block", "Discard")
+	waitMap(t, id)
+	server := httptest.NewServer(http.HandlerFunc(jobRoute))
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/jobs/%d/events", server.URL, id))
+	if err != nil {
+		close(unblock)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var statuses []status
+	done := false
+	scanner := bufio.NewScanner(resp.Body)
+	for !done && scanner.Scan() {
+		line := scanner.Text()
+		if line == "event: done" {
+			done = true
+		} else if data, ok := strings.CutPrefix(line, "data: "); ok && data != "{}" {
+			var st status
+			if err := json.Unmarshal([]byte(data), &st); err != nil {
+				t.Fatal(err)
+			}
+			if len(statuses) == 0 {
+				//The job can finish once the first status has been read.
+				close(unblock)
+			}
+			statuses = append(statuses, st)
+		}
+	}
+	if !done {
+		t.Fatalf("no done event: %v", scanner.Err())
+	}
+
+	first, last := statuses[0], statuses[len(statuses)-1]
+	if !first.Running || first.State != "running" || first.Workers != 1 || first.Counters["layer0.map.in"] == 0 {
+		t.Errorf("first status = %+v, want a running job that has mapped a record", first)
+	}
+	for _, phase := range []string{"layer0.map", "output"} {
+		if _, ok := first.Backlog[phase]; !ok {
+			t.Errorf("first status has no backlog for %s: %+v", phase, first.Backlog)
+		}
+	}
+	if last.Running || last.State != "finished" || last.Records != 2 || last.Finished != last.Workers {
+		t.Errorf("last status = %+v, want a finished job with 2 records", last)
+	}
+	if last.Counters["input.input.records"] != 2 || last.Counters["layer0.map.in"] != 2 {
+		t.Errorf("last counters = %v, want 2 records read and mapped", last.Counters)
+	}
+}
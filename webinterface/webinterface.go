@@ -4,7 +4,10 @@ package webinterface
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"html"
+	"log/slog"
 	d "mapreduce/datatypes"
 	"net/http"
 	"os"
@@ -19,6 +22,8 @@ var jobMap map[string]d.Job = make(map[string]d.Job)
 //if the user wants to set them themself every time instead.
 var Base, Input, Output string = getwd(), "input/", "output.txt"
 var Num int = 10
+//Logger is the logger given to every job started from the web interface.
+var Logger *slog.Logger = slog.Default()
 //Hostname and Port determine the binding of the server
 var Hostname string =  "localhost"
 var Port int = 8080
@@ -37,10 +42,117 @@ func RegisterJob(name string, job d.Job) {
 	jobMap[name] = job
 }
 
+//Param describes the parameter of a registered input or output.
+type Param struct {
+	//Description is shown next to the parameter's text box. Without one, no
+	//text box is shown and the parameter is empty.
+	Description string
+	//Path parameters are relative to the base directory, and default to
+	//Input or Output.
+	Path bool
+}
+
+type inputEntry struct {
+	name  string
+	param Param
+	input d.Input
+}
+
+type outputEntry struct {
+	name   string
+	param  Param
+	output func() d.Output
+}
+
+//Inputs and outputs are kept in the order they were registered, the first
+//one being the default.
+var inputs []inputEntry
+var outputs []outputEntry
+
+//Inputs must be registered by name in order to be selectable from the web
+//interface. The Param of the input is set from the form. Registering a name
+//again replaces the input. FileInputErr and StdInput are registered as
+//"File" and "Standard in".
+func RegisterInput(name string, param Param, input d.Input) {
+	for i, entry := range inputs {
+		if entry.name == name {
+			inputs[i] = inputEntry{name, param, input}
+			return
+		}
+	}
+	inputs = append(inputs, inputEntry{name, param, input})
+}
+
+//Outputs must be registered by name in order to be selectable from the web
+//interface. Outputs often hold state, such as an open file, so a new Output
+//is made for every job and its Param is set from the form. Registering a
+//name again replaces the output. MakeFileOutputErr and StdOutput are
+//registered as "File" and "Standard out".
+func RegisterOutput(name string, param Param, output func() d.Output) {
+	for i, entry := range outputs {
+		if entry.name == name {
+			outputs[i] = outputEntry{name, param, output}
+			return
+		}
+	}
+	outputs = append(outputs, outputEntry{name, param, output})
+}
+
+func init() {
+	RegisterInput("File", Param{Description: "File or directory to read, relative to the base directory", Path: true},
+		d.Input{GenInputErr: d.FileInputErr})
+	RegisterInput("Standard in", Param{}, d.Input{GenInput: d.StdInput})
+	RegisterOutput("File", Param{Description: "File to write, relative to the base directory", Path: true},
+		func() d.Output {
+			i, g, e := d.MakeFileOutputErr()
+			return d.Output{InitOutputErr: i, GenOutputErr: g, EndOutputErr: e}
+		})
+	RegisterOutput("Standard out", Param{}, func() d.Output {
+		return d.Output{GenOutput: d.StdOutput}
+	})
+}
+
+func lookupInput(name string) (inputEntry, bool) {
+	for _, entry := range inputs {
+		if entry.name == name {
+			return entry, true
+		}
+	}
+	return inputEntry{}, false
+}
+
+func lookupOutput(name string) (outputEntry, bool) {
+	for _, entry := range outputs {
+		if entry.name == name {
+			return entry, true
+		}
+	}
+	return outputEntry{}, false
+}
+
+//param returns the parameter to use, relative to the base directory if it
+//is a path.
+func (p Param) param(baseDir, value string) string {
+	if p.Description == "" {
+		return ""
+	} else if p.Path {
+		return baseDir + value
+	}
+	return value
+}
+
 //Run() runs http.ListenAndServe for the current hostname and port
 func Run() error {
+	if err := initHistory(); err != nil {
+		return err
+	}
 	http.HandleFunc("/", handler)
 	http.HandleFunc("/submit", submit)
+	http.HandleFunc("/jobs", jobList)
+	http.HandleFunc("/jobs/", jobRoute)
+	http.HandleFunc("/history", historyList)
+	http.HandleFunc("/history/", historyPage)
+	http.HandleFunc("/api/", apiRoute)
 	return http.ListenAndServe(fmt.Sprintf("%s:%d", Hostname, Port), nil)
 }
 
@@ -49,56 +161,129 @@ func submit(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Could not parse request: %v", err), 500)
+		return
 	}
 
 	if r.PostForm["layer"] == nil || r.PostForm["num"] == nil ||
 		len(r.PostForm["layer"]) != len(r.PostForm["num"]) {
 		http.Error(w, "Malformed request", 400)
+		return
 	}
 
-	baseDir := r.FormValue("baseDir")
-	if baseDir == "" {
+	if r.FormValue("baseDir") == "" {
 		http.Redirect(w, r, "/", 307)
 		return
 	}
 
-	if !strings.HasSuffix(baseDir, "/") {
-		baseDir += "/"
-	}
-	stdIn := r.FormValue("stdIn")
-	stdOut := r.FormValue("stdOut")
-
-	master := d.Master{BaseDir: baseDir}
-
-	if stdIn != "" {
-		master.SetInput(d.Input{Param: "", GenInput: d.StdInput})
-	} else {
-		inputLoc := baseDir + r.FormValue("input")
-		master.SetInput(d.Input{Param: inputLoc, GenInput: d.FileInput})
+	request := jobRequest{
+		BaseDir:    r.FormValue("baseDir"),
+		InputType:  r.FormValue("inputType"),
+		Input:      r.FormValue("input"),
+		OutputType: r.FormValue("outputType"),
+		Output:     r.FormValue("output"),
 	}
-
 	for i, l := range r.PostForm["layer"] {
 		num, err := strconv.Atoi(r.PostForm["num"][i])
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Illegal 'num': %s", r.PostForm["num"][i]), 400)
+			return
 		}
+		request.Layers = append(request.Layers, layerRequest{Job: l, Workers: num})
+	}
+
+	name, master, err := request.master()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	j := startJob(name, master, request)
+	http.Redirect(w, r, fmt.Sprintf("/jobs/%d", j.id), 303)
+
+}
+
+//jobRequest describes a job to run, from the form or from the JSON API.
+//InputType and OutputType name a registered input and output, and default to
+//the first one registered. Input and Output are their parameters. StdIn and
+//StdOut select "Standard in" and "Standard out" instead.
+type jobRequest struct {
+	BaseDir    string         `json:"baseDir"`
+	InputType  string         `json:"inputType"`
+	Input      string         `json:"input"`
+	StdIn      bool           `json:"stdIn"`
+	OutputType string         `json:"outputType"`
+	Output     string         `json:"output"`
+	StdOut     bool           `json:"stdOut"`
+	Layers     []layerRequest `json:"layers"`
+}
+
+//layerRequest names a registered job to run as a layer, see RegisterJob.
+type layerRequest struct {
+	Job     string `json:"job"`
+	Workers int    `json:"workers"`
+}
 
-		master.SetLayer(num, jobMap[l])
+//master builds the Master for the request, and returns it along with a name
+//for the job. An error is returned if a job, input or output name is not
+//registered. The base directory and the input and output types of the
+//request are resolved, so that it records exactly what was run.
+func (request *jobRequest) master() (string, *d.Master, error) {
+	if len(request.Layers) == 0 {
+		return "", nil, errors.New("at least one layer is required")
 	}
+	if !strings.HasSuffix(request.BaseDir, "/") {
+		request.BaseDir += "/"
+	}
+	baseDir := request.BaseDir
 
-	if stdOut != "" {
-		master.SetOutput(d.Output{Param: "", GenOutput: d.StdOutput})
-	} else {
-		outputLoc := baseDir + r.FormValue("output")
-		i, g, e := d.MakeFileOutput()
-		master.SetOutput(d.Output{Param: outputLoc, InitOutput: i, GenOutput: g, EndOutput: e})
+	var names []string
+	for _, l := range request.Layers {
+		names = append(names, l.Job)
 	}
+	name := strings.Join(names, ", ")
+	master := &d.Master{Name: name, BaseDir: baseDir}
+	master.SetLogger(Logger)
 
-	go master.Run()
+	if request.StdIn {
+		request.InputType, request.StdIn = "Standard in", false
+	} else if request.InputType == "" && len(inputs) > 0 {
+		request.InputType = inputs[0].name
+	}
+	if request.StdOut {
+		request.OutputType, request.StdOut = "Standard out", false
+	} else if request.OutputType == "" && len(outputs) > 0 {
+		request.OutputType = outputs[0].name
+	}
+	inputType, outputType := request.InputType, request.OutputType
 
-	http.Redirect(w, r, "/", 307)
+	in, ok := lookupInput(inputType)
+	if !ok {
+		return "", nil, fmt.Errorf("unknown input %q", inputType)
+	}
+	input := in.input
+	input.Param = in.param.param(baseDir, request.Input)
+	master.SetInput(input)
 
+	for _, l := range request.Layers {
+		job, ok := jobMap[l.Job]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown job %q", l.Job)
+		}
+		if l.Workers < 1 {
+			return "", nil, fmt.Errorf("illegal number of workers for %q: %d", l.Job, l.Workers)
+		}
+		master.SetLayer(l.Workers, job)
+	}
+
+	out, ok := lookupOutput(outputType)
+	if !ok {
+		return "", nil, fmt.Errorf("unknown output %q", outputType)
+	}
+	output := out.output()
+	output.Param = out.param.param(baseDir, request.Output)
+	master.SetOutput(output)
+	return name, master, nil
 }
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	var buffer bytes.Buffer
 	for name := range jobMap {
@@ -108,6 +293,13 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		buffer.WriteString(name)
 		buffer.WriteString("</option>\n")
 	}
+	var inputOptions, outputOptions bytes.Buffer
+	for _, entry := range inputs {
+		writeParamOption(&inputOptions, entry.name, entry.param, Input)
+	}
+	for _, entry := range outputs {
+		writeParamOption(&outputOptions, entry.name, entry.param, Output)
+	}
 
 	output := `<html><head>
 <script>
@@ -122,12 +314,12 @@ function addLayer() {
 	parent.appendChild(child);
 	return false;
 }
-function check(name, box) {
-	if (box.checked) {
-        document.getElementById(name).style.display = 'none';
-	} else {
-        document.getElementById(name).style.display = 'block';
-	}
+function selectParam(name, select) {
+	var option = select.options[select.selectedIndex];
+	var box = document.getElementById(name + 'Box');
+	box.style.display = option.dataset.description ? 'block' : 'none';
+	box.getElementsByClassName('description')[0].textContent = option.dataset.description;
+	box.getElementsByTagName('input')[0].value = option.dataset.default;
 	return false;
 }
 </script>
@@ -154,29 +346,27 @@ Base Directory:<br>
 		Base +
 		`">
 <br>
-<div id="inputBox">
 Input:<br>
-<input type="text" name="input" value="` +
-		Input +
-		`">
+<select name="inputType" onchange="selectParam('input', this)">` +
+		inputOptions.String() +
+		`</select>
+<br>
+<div id="inputBox">
+<span class="description"></span>:<br>
+<input type="text" name="input" value="">
 <br>
 </div>
 
-<input type="checkbox" name="stdIn" value="stdIn"
-onclick="check('inputBox', this)">
- Read from standard in<br>
- 
-<div id="outputBox">
 Output:<br>
-<input type="text" name="output" value="` +
-		Output +
-		`">
+<select name="outputType" onchange="selectParam('output', this)">` +
+		outputOptions.String() +
+		`</select>
+<br>
+<div id="outputBox">
+<span class="description"></span>:<br>
+<input type="text" name="output" value="">
 <br>
 </div>
-
-<input type="checkbox" name="stdOut" value="stdOut"
-onclick="check('outputBox', this)">
- Print to standard out<br>
  
 <div id="layers">
 </div>
@@ -186,6 +376,22 @@ Add New Layer</button>
 <br>
 <input type="submit" value="Submit">
 </form>
+<a href="/jobs">All jobs</a> <a href="/history">History</a>
+<script>
+selectParam('input', document.getElementsByName('inputType')[0]);
+selectParam('output', document.getElementsByName('outputType')[0]);
+</script>
 </body></html>`
 	fmt.Fprintln(w, output)
 }
+
+//writeParamOption writes a drop-down option for a registered input or output,
+//recording its parameter's description and default value for selectParam.
+func writeParamOption(buffer *bytes.Buffer, name string, param Param, pathDefault string) {
+	value := ""
+	if param.Path {
+		value = pathDefault
+	}
+	fmt.Fprintf(buffer, "<option value=\"%s\" data-description=\"%s\" data-default=\"%s\">%s</option>\n",
+		html.EscapeString(name), html.EscapeString(param.Description), html.EscapeString(value), html.EscapeString(name))
+}
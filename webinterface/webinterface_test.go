@@ -0,0 +1,104 @@
+package webinterface
+
+import (
+	d "mapreduce/datatypes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+//TestRegistry registers inputs and outputs, and checks which of them a
+//request runs, with which parameters, and how the form offers them.
+func TestRegistry(t *testing.T) {
+	defer func(in []inputEntry, out []outputEntry) { inputs, outputs = in, out }(inputs, outputs)
+	inputs, outputs = nil, nil
+
+	//Each input emits its own name, with its parameter as the value.
+	input := func(name string) d.Input {
+		return d.Input{GenInput: func(param string, emitter d.Emitter) {
+			emitter.Emit(name, param)
+		}}
+	}
+	//written holds what the "collect" output wrote, and its parameter.
+	var written [][3]string
+	collect := func() d.Output {
+		return d.Output{GenOutput: func(param, key, value string) {
+			written = append(written, [3]string{key, value, param})
+		}}
+	}
+	discard := func() d.Output {
+		return d.Output{GenOutput: func(param, key, value string) {}}
+	}
+	RegisterInput("first", Param{Description: "Old"}, input("old"))
+	RegisterInput("second", Param{Description: "Text"}, input("second"))
+	RegisterInput("none & more", Param{}, input("none"))
+	RegisterInput("first", Param{Description: "Path", Path: true}, input("first"))
+	RegisterOutput("collect", Param{}, discard)
+	RegisterOutput("discard", Param{}, discard)
+	RegisterOutput("collect", Param{Description: "Name", Path: true}, collect)
+
+	tests := []struct {
+		name    string
+		request jobRequest
+		//want is the record written, and the output's parameter.
+		want      [3]string
+		inputType string
+	}{
+		{"defaults", jobRequest{BaseDir: "/base", Input: "in.txt", Output: "out.txt"},
+			[3]string{"first", "/base/in.txt", "/base/out.txt"}, "first"},
+		{"text parameter", jobRequest{BaseDir: "/base/", InputType: "second", Input: "in.txt", Output: "out.txt"},
+			[3]string{"second", "in.txt", "/base/out.txt"}, "second"},
+		{"no parameter", jobRequest{BaseDir: "/base", InputType: "none & more", Input: "in.txt", Output: "out.txt"},
+			[3]string{"none", "", "/base/out.txt"}, "none & more"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			written = nil
+			test.request.Layers = []layerRequest{{Job: "identity", Workers: 2}}
+			_, master, err := test.request.master()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.request.InputType != test.inputType || test.request.OutputType != "collect" {
+				t.Errorf("request resolved to %q and %q, want %q and %q", test.request.InputType, test.request.OutputType, test.inputType, "collect")
+			}
+			if _, err := master.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if want := [][3]string{test.want}; !slices.Equal(written, want) {
+				t.Errorf("written = %q, want %q", written, want)
+			}
+		})
+	}
+
+	request := jobRequest{BaseDir: "/base", InputType: "old", Layers: []layerRequest{{Job: "identity", Workers: 1}}}
+	if _, _, err := request.master(); err == nil {
+		t.Error("an unregistered input was accepted")
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	page := w.Body.String()
+	options := []string{
+		`<option value="first" data-description="Path" data-default="input/">first</option>`,
+		`<option value="second" data-description="Text" data-default="">second</option>`,
+		`<option value="none &amp; more" data-description="" data-default="">none &amp; more</option>`,
+		`<option value="collect" data-description="Name" data-default="output.txt">collect</option>`,
+		`<option value="discard" data-description="" data-default="">discard</option>`,
+	}
+	last := -1
+	for _, option := range options {
+		i := strings.Index(page, option)
+		if i < 0 {
+			t.Errorf("form has no %s:\n%s", option, page)
+		} else if i < last {
+			t.Errorf("%s is out of order", option)
+		}
+		last = i
+	}
+	if !strings.Contains(page, `<option value="identity">identity</option>`) {
+		t.Errorf("form does not offer the identity job:\n%s", page)
+	}
+}